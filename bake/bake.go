@@ -5,20 +5,29 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/compose-spec/compose-go/dotenv"
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/buildx/bake/hclparser"
 	"github.com/docker/buildx/build"
 	"github.com/docker/buildx/util/buildflags"
 	"github.com/docker/buildx/util/platformutil"
+	"github.com/docker/cli/opts"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/pkg/urlutil"
+	"github.com/docker/go-units"
 	hcl "github.com/hashicorp/hcl/v2"
+	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/session/auth/authprovider"
 	"github.com/pkg/errors"
@@ -30,8 +39,42 @@ var (
 
 	validTargetNameChars = `[a-zA-Z0-9_-]+`
 	targetNamePattern    = regexp.MustCompile(`^` + validTargetNameChars + `$`)
+
+	dockerfileStagePattern = regexp.MustCompile(`(?im)^\s*FROM\s+(?:--\S+\s+)*\S+\s+AS\s+(\S+)\s*$`)
+
+	annotationKeyPattern  = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]*[a-zA-Z0-9])?$`)
+	annotationTypePattern = regexp.MustCompile(`^(index|manifest|index-descriptor|manifest-descriptor)(\[[^\]]+\])?:(.*)$`)
+
+	// SensitiveArgsPattern matches the names of build args whose values are
+	// masked by default when printing targets.
+	SensitiveArgsPattern = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD)`)
 )
 
+const maskedValue = "*****"
+
+// resetSentinel is the list entry clearing the values inherited by a target
+// for the field.
+const resetSentinel = "!reset"
+
+// cacheImportTypes are the cache backends that can be used in cache-from.
+var cacheImportTypes = map[string]struct{}{
+	"azblob":   {},
+	"gha":      {},
+	"local":    {},
+	"registry": {},
+	"s3":       {},
+}
+
+// knownArgTypes are the types of the values expected by the frontend for the
+// well-known build args it interprets.
+var knownArgTypes = map[string]string{
+	"BUILDKIT_CONTEXT_KEEP_GIT_DIR":   "bool",
+	"BUILDKIT_INLINE_BUILDINFO_ATTRS": "bool",
+	"BUILDKIT_INLINE_CACHE":           "bool",
+	"BUILDKIT_MULTI_PLATFORM":         "bool",
+	"SOURCE_DATE_EPOCH":               "int",
+}
+
 type File struct {
 	Name string
 	Data []byte
@@ -53,7 +96,14 @@ func defaultFilenames() []string {
 	}
 }
 
+// ReadLocalFiles reads the definition files names, or the default files if
+// names is empty. A - name reads the definition from stdin, in the order it
+// is declared among the other files. Its format is detected from its content.
 func ReadLocalFiles(names []string) ([]File, error) {
+	return readLocalFiles(names, os.Stdin)
+}
+
+func readLocalFiles(names []string, stdin io.Reader) ([]File, error) {
 	isDefault := false
 	if len(names) == 0 {
 		isDefault = true
@@ -65,7 +115,7 @@ func ReadLocalFiles(names []string) ([]File, error) {
 		var dt []byte
 		var err error
 		if n == "-" {
-			dt, err = io.ReadAll(os.Stdin)
+			dt, err = io.ReadAll(stdin)
 			if err != nil {
 				return nil, err
 			}
@@ -84,21 +134,56 @@ func ReadLocalFiles(names []string) ([]File, error) {
 }
 
 func ReadTargets(ctx context.Context, files []File, targets, overrides []string, defaults map[string]string) (map[string]*Target, []*Group, error) {
-	c, err := ParseFiles(files, defaults)
+	m, g, _, err := ReadTargetsWithOpt(ctx, files, targets, overrides, ReadOpt{ParseOpt: ParseOpt{Defaults: defaults}})
+	return m, g, err
+}
+
+// ReadOpt holds the options of reading the targets of bake definition files.
+type ReadOpt struct {
+	ParseOpt
+	// Output is set as the output of all the targets with
+	// ApplyOutputOverride, before the overrides are applied.
+	Output string
+	// PreserveOutputs applies Output with ApplyOutputOverridePreserving
+	// instead.
+	PreserveOutputs bool
+}
+
+// ReadTargetsWithOpt is like ReadTargets, with the options of opt. The
+// warnings of the parsed definition are returned alongside the targets.
+func ReadTargetsWithOpt(ctx context.Context, files []File, targets, overrides []string, opt ReadOpt) (map[string]*Target, []*Group, []string, error) {
+	c, err := ParseFilesWithOpt(files, opt.ParseOpt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if opt.Output != "" {
+		if opt.PreserveOutputs {
+			ApplyOutputOverridePreserving(c, opt.Output)
+		} else {
+			ApplyOutputOverride(c, opt.Output)
+		}
+	}
+
+	targets, err = c.expandTargetsAndGroups(targets)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+
+	if err := c.validateGroupCycles(targets); err != nil {
+		return nil, nil, nil, err
 	}
 
 	o, err := c.newOverrides(overrides)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	m := map[string]*Target{}
 	for _, n := range targets {
 		for _, n := range c.ResolveGroup(n) {
 			t, err := c.ResolveTarget(n, o)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 			if t != nil {
 				m[n] = t
@@ -134,11 +219,45 @@ func ReadTargets(ctx context.Context, files []File, targets, overrides []string,
 
 	for name, t := range m {
 		if err := c.loadLinks(name, t, m, o, nil); err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 
-	return m, g, nil
+	for name, t := range m {
+		if err := t.validate(name); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return m, g, c.Warnings, nil
+}
+
+// ResolveTarget returns target name of cfg as it would be built, once merged
+// with the targets it inherits from and with overrides applied. Overrides use
+// the --set grammar, mapping target.field or target.field.key patterns to
+// their value.
+func ResolveTarget(cfg *Config, name string, overrides map[string]string) (*Target, error) {
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	v := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v = append(v, k+"="+overrides[k])
+	}
+	o, err := cfg.newOverrides(v)
+	if err != nil {
+		return nil, err
+	}
+	t, err := cfg.ResolveTarget(name, o)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validate(name); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
 func dedupString(s []string) []string {
@@ -156,21 +275,43 @@ func dedupString(s []string) []string {
 	return res
 }
 
-func ParseFiles(files []File, defaults map[string]string) (_ *Config, err error) {
+// ParseOpt holds the options of parsing bake definition files.
+type ParseOpt struct {
+	// Defaults are the values of the built-in HCL variables.
+	Defaults map[string]string
+	// Values resolve the HCL variables not set in the environment, before
+	// their default.
+	Values map[string]string
+	// Profiles are the active profiles of compose files.
+	Profiles []string
+}
+
+func ParseFiles(files []File, defaults map[string]string) (*Config, error) {
+	return ParseFilesWithOpt(files, ParseOpt{Defaults: defaults})
+}
+
+// ParseFilesWithOpt is like ParseFiles, with the options of opt.
+func ParseFilesWithOpt(files []File, opt ParseOpt) (_ *Config, err error) {
 	defer func() {
 		err = formatHCLError(err, files)
 	}()
 
 	var c Config
 	var fs []*hcl.File
+	var warnings []string
 	for _, f := range files {
-		cfg, isCompose, composeErr := ParseComposeFile(f.Data, f.Name)
+		cfg, isCompose, composeErr := parseComposeFile(f.Data, f.Name, ComposeOpt{Profiles: opt.Profiles})
 		if isCompose {
 			if composeErr != nil {
 				return nil, composeErr
 			}
-			c = mergeConfig(c, *cfg)
-			c = dedupeConfig(c)
+			warnings = append(warnings, cfg.Warnings...)
+			if c, err = mergeConfig(c, *cfg, MergeLastWins); err != nil {
+				return nil, err
+			}
+			if c, err = dedupeConfig(c, MergeLastWins); err != nil {
+				return nil, err
+			}
 		}
 		if !isCompose {
 			hf, isHCL, err := ParseHCLFile(f.Data, f.Name)
@@ -188,55 +329,135 @@ func ParseFiles(files []File, defaults map[string]string) (_ *Config, err error)
 	}
 
 	if len(fs) > 0 {
-		if err := hclparser.Parse(hcl.MergeFiles(fs), hclparser.Opt{
-			LookupVar:     os.LookupEnv,
-			Vars:          defaults,
+		meta, err := hclparser.Parse(hcl.MergeFiles(fs), hclparser.Opt{
+			LookupVar:     lookupVarWithValues(opt.Values),
+			Vars:          opt.Defaults,
 			ValidateLabel: validateTargetName,
-		}, &c); err.HasErrors() {
+		}, &c)
+		if err.HasErrors() {
 			return nil, err
 		}
+		// the label of a matrix target refers to the targets created from it
+		labels := make([]string, 0, len(meta.Renamed["target"]))
+		for label := range meta.Renamed["target"] {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			if c.hasGroup(label) {
+				continue
+			}
+			c.Groups = append(c.Groups, &Group{Name: label, Targets: meta.Renamed["target"][label]})
+		}
 	}
+	c.Warnings = warnings
 	return &c, nil
 }
 
-func dedupeConfig(c Config) Config {
+func dedupeConfig(c Config, policy MergePolicy) (Config, error) {
 	c2 := c
 	c2.Targets = make([]*Target, 0, len(c2.Targets))
 	m := map[string]*Target{}
 	for _, t := range c.Targets {
 		if t2, ok := m[t.Name]; ok {
-			t2.Merge(t)
+			if t2 == t {
+				// mergeConfig keeps merged targets in place
+				continue
+			}
+			if err := t2.MergeWithPolicy(t, policy); err != nil {
+				return c, err
+			}
 		} else {
 			m[t.Name] = t
 			c2.Targets = append(c2.Targets, t)
 		}
 	}
-	return c2
+	return c2, nil
 }
 
 func ParseFile(dt []byte, fn string) (*Config, error) {
 	return ParseFiles([]File{{Data: dt, Name: fn}}, nil)
 }
 
+// ParseComposeFile parses dt as a compose file if fn has a yaml extension, or
+// no known extension and dt is a valid compose file.
 func ParseComposeFile(dt []byte, fn string) (*Config, bool, error) {
+	return parseComposeFile(dt, fn, ComposeOpt{})
+}
+
+func parseComposeFile(dt []byte, fn string, opt ComposeOpt) (*Config, bool, error) {
+	if fn != "-" {
+		// included files are relative to the including compose file
+		opt.WorkingDir = filepath.Dir(fn)
+	}
 	fnl := strings.ToLower(fn)
 	if strings.HasSuffix(fnl, ".yml") || strings.HasSuffix(fnl, ".yaml") {
-		cfg, err := ParseCompose(dt)
+		cfg, err := ParseComposeWithOpt(dt, opt)
 		return cfg, true, err
 	}
 	if strings.HasSuffix(fnl, ".json") || strings.HasSuffix(fnl, ".hcl") {
 		return nil, false, nil
 	}
-	cfg, err := ParseCompose(dt)
+	cfg, err := ParseComposeWithOpt(dt, opt)
 	return cfg, err == nil, err
 }
 
 type Config struct {
 	Groups  []*Group  `json:"group" hcl:"group,block"`
 	Targets []*Target `json:"target" hcl:"target,block"`
+
+	// Warnings are the issues found while parsing the definition that don't
+	// prevent building it.
+	Warnings []string `json:"-"`
+}
+
+// Merge merges other into c. Targets with the same name are merged field by
+// field: scalars and maps are set from other, while lists are appended unless
+// other resets them with a !reset entry. Groups with the same name get the
+// union of their targets. An error is returned if a name is used by a group
+// in one config and by a target in the other. The groups and targets of
+// other are copied, so other can be reused after merging.
+func (c *Config) Merge(other *Config) error {
+	for _, f := range []struct {
+		groups  []*Group
+		targets []*Target
+	}{
+		{c.Groups, other.Targets},
+		{other.Groups, c.Targets},
+	} {
+		for _, g := range f.groups {
+			for _, t := range f.targets {
+				if g.Name == t.Name {
+					return errors.Errorf("cannot merge target %s with group of the same name", t.Name)
+				}
+			}
+		}
+	}
+	o := Config{
+		Groups:  make([]*Group, 0, len(other.Groups)),
+		Targets: make([]*Target, 0, len(other.Targets)),
+	}
+	for _, g := range other.Groups {
+		g2 := *g
+		g2.Targets = copySlice(g.Targets)
+		o.Groups = append(o.Groups, &g2)
+	}
+	for _, t := range other.Targets {
+		o.Targets = append(o.Targets, t.clone())
+	}
+	res, err := mergeConfig(*c, o, MergeDeep)
+	if err != nil {
+		return err
+	}
+	res, err = dedupeConfig(res, MergeDeep)
+	if err != nil {
+		return err
+	}
+	*c = res
+	return nil
 }
 
-func mergeConfig(c1, c2 Config) Config {
+func mergeConfig(c1, c2 Config, policy MergePolicy) (Config, error) {
 	if c1.Groups == nil {
 		c1.Groups = []*Group{}
 	}
@@ -253,6 +474,9 @@ func mergeConfig(c1, c2 Config) Config {
 			c1.Groups = append(c1.Groups, g2)
 			continue
 		}
+		if g2.Description != nil {
+			g1.Description = g2.Description
+		}
 
 	nextTarget:
 		for _, t2 := range g2.Targets {
@@ -263,7 +487,6 @@ func mergeConfig(c1, c2 Config) Config {
 			}
 			g1.Targets = append(g1.Targets, t2)
 		}
-		c1.Groups = append(c1.Groups, g1)
 	}
 
 	if c1.Targets == nil {
@@ -279,174 +502,781 @@ func mergeConfig(c1, c2 Config) Config {
 			}
 		}
 		if t1 != nil {
-			t1.Merge(t2)
+			if err := t1.MergeWithPolicy(t2, policy); err != nil {
+				return c1, err
+			}
 			t2 = t1
 		}
 		c1.Targets = append(c1.Targets, t2)
 	}
 
-	return c1
+	return c1, nil
 }
 
-func (c Config) expandTargets(pattern string) ([]string, error) {
-	for _, target := range c.Targets {
-		if target.Name == pattern {
-			return []string{pattern}, nil
+// Prune removes targets that do not define any build context, dockerfile or
+// inline dockerfile, either directly or through inheritance, and drops them
+// from the groups referencing them. Targets inherited by a remaining target
+// are kept. It returns the names of the pruned targets.
+func (c *Config) Prune() []string {
+	keep := map[string]struct{}{}
+	var visit func(name string)
+	visit = func(name string) {
+		if _, ok := keep[name]; ok {
+			return
+		}
+		keep[name] = struct{}{}
+		for _, t := range c.Targets {
+			if t.Name == name {
+				for _, p := range t.Inherits {
+					visit(p)
+				}
+			}
 		}
 	}
-
-	var names []string
-	for _, target := range c.Targets {
-		ok, err := path.Match(pattern, target.Name)
-		if err != nil {
-			return nil, errors.Wrapf(err, "could not match targets with '%s'", pattern)
+	for _, t := range c.Targets {
+		rt, err := c.target(t.Name, map[string]*Target{}, nil)
+		if err != nil || rt.Context != nil || rt.Dockerfile != nil || rt.DockerfileInline != nil {
+			// targets that cannot be resolved are reported when built
+			visit(t.Name)
 		}
-		if ok {
-			names = append(names, target.Name)
+	}
+
+	var pruned []string
+	targets := make([]*Target, 0, len(c.Targets))
+	for _, t := range c.Targets {
+		if _, ok := keep[t.Name]; !ok {
+			pruned = append(pruned, t.Name)
+			continue
 		}
+		targets = append(targets, t)
 	}
-	if len(names) == 0 {
-		return nil, errors.Errorf("could not find any target matching '%s'", pattern)
+	if len(pruned) == 0 {
+		return nil
 	}
-	return names, nil
-}
+	c.Targets = targets
 
-func (c Config) loadLinks(name string, t *Target, m map[string]*Target, o map[string]map[string]Override, visited []string) error {
-	visited = append(visited, name)
-	for _, v := range t.Contexts {
-		if strings.HasPrefix(v, "target:") {
-			target := strings.TrimPrefix(v, "target:")
-			if target == t.Name {
-				return errors.Errorf("target %s cannot link to itself", target)
-			}
-			for _, v := range visited {
-				if v == target {
-					return errors.Errorf("infinite loop from %s to %s", name, target)
-				}
-			}
-			t2, ok := m[target]
-			if !ok {
-				var err error
-				t2, err = c.ResolveTarget(target, o)
-				if err != nil {
-					return err
-				}
-				t2.Outputs = nil
-				t2.linked = true
-				m[target] = t2
-			}
-			if err := c.loadLinks(target, t2, m, o, visited); err != nil {
-				return err
-			}
-			if len(t.Platforms) > 1 && len(t2.Platforms) > 1 {
-				if !sliceEqual(t.Platforms, t2.Platforms) {
-					return errors.Errorf("target %s can't be used by %s because it is defined for different platforms %v and %v", target, name, t2.Platforms, t.Platforms)
+	for _, g := range c.Groups {
+		gt := make([]string, 0, len(g.Targets))
+	nextTarget:
+		for _, t := range g.Targets {
+			for _, p := range pruned {
+				if t == p {
+					continue nextTarget
 				}
 			}
+			gt = append(gt, t)
 		}
+		g.Targets = gt
 	}
-	return nil
+	return pruned
 }
 
-func (c Config) newOverrides(v []string) (map[string]map[string]Override, error) {
-	m := map[string]map[string]Override{}
-	for _, v := range v {
-		parts := strings.SplitN(v, "=", 2)
-		keys := strings.SplitN(parts[0], ".", 3)
-		if len(keys) < 2 {
-			return nil, errors.Errorf("invalid override key %s, expected target.name", parts[0])
+// Sort orders the groups and targets by name, as well as the targets of each
+// group, so the config marshals to the same output whatever the order they
+// were loaded in.
+func (c *Config) Sort() {
+	sort.SliceStable(c.Groups, func(i, j int) bool {
+		return c.Groups[i].Name < c.Groups[j].Name
+	})
+	for _, g := range c.Groups {
+		sort.Strings(g.Targets)
+	}
+	sort.SliceStable(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+}
+
+// TargetInfo describes a group or a target of a config as listed by
+// ListTargets.
+type TargetInfo struct {
+	Name        string `json:"name"`
+	Group       bool   `json:"group,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ListTargets returns the groups of cfg followed by its targets, each sorted
+// by name, without resolving them.
+func ListTargets(cfg *Config) []TargetInfo {
+	groups := make([]TargetInfo, 0, len(cfg.Groups))
+	for _, g := range cfg.Groups {
+		info := TargetInfo{Name: g.Name, Group: true}
+		if g.Description != nil {
+			info.Description = *g.Description
+		}
+		groups = append(groups, info)
+	}
+	targets := make([]TargetInfo, 0, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		info := TargetInfo{Name: t.Name}
+		if t.Description != nil {
+			info.Description = *t.Description
 		}
+		targets = append(targets, info)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return append(groups, targets...)
+}
 
-		pattern := keys[0]
-		if len(parts) != 2 && keys[1] != "args" {
-			return nil, errors.Errorf("invalid override %s, expected target.name=value", v)
+// TargetsAffectedBy returns the sorted names of the targets of c whose local
+// build context contains one of files, or whose dockerfile is one of them.
+// Targets using an affected target as named context are affected too. Paths
+// are relative to the current directory unless absolute.
+func (c *Config) TargetsAffectedBy(files []string) []string {
+	abs := make([]string, 0, len(files))
+	for _, f := range files {
+		if p, err := filepath.Abs(f); err == nil {
+			abs = append(abs, p)
 		}
+	}
+	contains := func(dir, fn string) bool {
+		rel, err := filepath.Rel(dir, fn)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
 
-		names, err := c.expandTargets(pattern)
+	affected := map[string]struct{}{}
+	deps := map[string][]string{}
+	for _, t := range c.Targets {
+		rt, err := c.ResolveTarget(t.Name, nil)
 		if err != nil {
-			return nil, err
+			continue
 		}
-
-		kk := strings.SplitN(parts[0], ".", 2)
-
-		for _, name := range names {
-			t, ok := m[name]
-			if !ok {
-				t = map[string]Override{}
-				m[name] = t
+		for _, v := range rt.Contexts {
+			if strings.HasPrefix(v, "target:") {
+				dep := strings.TrimPrefix(v, "target:")
+				deps[dep] = append(deps[dep], t.Name)
 			}
-
-			o := t[kk[1]]
-
-			switch keys[1] {
-			case "output", "cache-to", "cache-from", "tags", "platform", "secrets", "ssh":
-				if len(parts) == 2 {
-					o.ArrValue = append(o.ArrValue, parts[1])
-				}
-			case "args":
-				if len(keys) != 3 {
-					return nil, errors.Errorf("invalid key %s, args requires name", parts[0])
-				}
-				if len(parts) < 2 {
-					v, ok := os.LookupEnv(keys[2])
-					if !ok {
-						continue
-					}
-					o.Value = v
-				}
-				fallthrough
-			case "contexts":
-				if len(keys) != 3 {
-					return nil, errors.Errorf("invalid key %s, contexts requires name", parts[0])
-				}
-				fallthrough
-			default:
-				if len(parts) == 2 {
-					o.Value = parts[1]
-				}
+		}
+		var dockerfile string
+		if rt.DockerfileInline == nil {
+			dockerfile, _, _, _ = rt.localDockerfilePath()
+		}
+		contextPath := strings.TrimPrefix(*rt.Context, "cwd://")
+		if contextPath == "-" || IsRemoteURL(contextPath) {
+			contextPath = ""
+		} else if contextPath, err = filepath.Abs(contextPath); err != nil {
+			contextPath = ""
+		}
+		for _, fn := range abs {
+			if fn == dockerfile || (contextPath != "" && contains(contextPath, fn)) {
+				affected[t.Name] = struct{}{}
+				break
 			}
+		}
+	}
 
-			t[kk[1]] = o
+	res := make([]string, 0, len(affected))
+	for name := range affected {
+		res = append(res, name)
+	}
+	for i := 0; i < len(res); i++ {
+		for _, n := range deps[res[i]] {
+			if _, ok := affected[n]; !ok {
+				affected[n] = struct{}{}
+				res = append(res, n)
+			}
 		}
 	}
-	return m, nil
+	sort.Strings(res)
+	return res
 }
 
-func (c Config) ResolveGroup(name string) []string {
-	return dedupString(c.group(name, map[string][]string{}))
+// ApplyDefaults sets the fields of d on every target that does not define
+// them yet. Fields explicitly set on a target are never overridden.
+func (c *Config) ApplyDefaults(d *Target) {
+	for _, t := range c.Targets {
+		t.applyDefaults(d)
+	}
 }
 
-func (c Config) group(name string, visited map[string][]string) []string {
-	if _, ok := visited[name]; ok {
-		return visited[name]
+// RetagWithRegistry rewrites the tags of every target to point at registry,
+// which can include a path prefix, preserving the repository path and tag.
+// Digest references are left untouched if keepDigests is set, otherwise an
+// error is returned and no target is modified.
+func (c *Config) RetagWithRegistry(registry string, keepDigests bool) error {
+	registry = strings.TrimSuffix(registry, "/")
+	retagged := make([][]string, len(c.Targets))
+	for i, t := range c.Targets {
+		tags := make([]string, 0, len(t.Tags))
+		for _, tag := range t.Tags {
+			named, err := reference.ParseNormalizedNamed(tag)
+			if err != nil {
+				return errors.Wrapf(err, "target %s: invalid tag %s", t.Name, tag)
+			}
+			if _, ok := named.(reference.Digested); ok {
+				if !keepDigests {
+					return errors.Errorf("target %s: cannot retag digest reference %s", t.Name, tag)
+				}
+				tags = append(tags, tag)
+				continue
+			}
+			repo := reference.Path(named)
+			if reference.Domain(named) == "docker.io" {
+				repo = strings.TrimPrefix(repo, "library/")
+			}
+			name := registry + "/" + repo
+			if tagged, ok := named.(reference.Tagged); ok {
+				name += ":" + tagged.Tag()
+			}
+			if _, err := reference.ParseNormalizedNamed(name); err != nil {
+				return errors.Wrapf(err, "target %s: invalid tag %s for registry %s", t.Name, name, registry)
+			}
+			tags = append(tags, name)
+		}
+		retagged[i] = tags
 	}
-	var g *Group
-	for _, group := range c.Groups {
-		if group.Name == name {
-			g = group
-			break
+	for i, t := range c.Targets {
+		if len(t.Tags) > 0 {
+			t.Tags = retagged[i]
 		}
 	}
-	if g == nil {
-		return []string{name}
+	return nil
+}
+
+// QualifyTags prefixes the tags of every target that lack a registry host
+// with registry, like app:1 becoming registry.example.com/app:1. Tags already
+// including a host are left untouched. An error is returned and no target is
+// modified if a tag is invalid.
+func (c *Config) QualifyTags(registry string) error {
+	registry = strings.TrimSuffix(registry, "/")
+	if registry == "" {
+		return nil
 	}
-	visited[name] = []string{}
-	targets := make([]string, 0, len(g.Targets))
-	for _, t := range g.Targets {
-		tgroup := c.group(t, visited)
-		if len(tgroup) > 0 {
-			targets = append(targets, tgroup...)
-		} else {
-			targets = append(targets, t)
+	qualified := make([][]string, len(c.Targets))
+	for i, t := range c.Targets {
+		tags := make([]string, 0, len(t.Tags))
+		for _, tag := range t.Tags {
+			named, err := reference.ParseNormalizedNamed(tag)
+			if err != nil {
+				return errors.Wrapf(err, "target %s: invalid tag %s", t.Name, tag)
+			}
+			if reference.Domain(named) != "docker.io" || strings.HasPrefix(tag, "docker.io/") || strings.HasPrefix(tag, "index.docker.io/") {
+				tags = append(tags, tag)
+				continue
+			}
+			name := registry + "/" + strings.TrimPrefix(reference.Path(named), "library/")
+			if tagged, ok := named.(reference.Tagged); ok {
+				name += ":" + tagged.Tag()
+			}
+			if digested, ok := named.(reference.Digested); ok {
+				name += "@" + digested.Digest().String()
+			}
+			if _, err := reference.ParseNormalizedNamed(name); err != nil {
+				return errors.Wrapf(err, "target %s: invalid tag %s for registry %s", t.Name, name, registry)
+			}
+			tags = append(tags, name)
 		}
+		qualified[i] = tags
 	}
-	visited[name] = targets
-	return targets
+	for i, t := range c.Targets {
+		if len(t.Tags) > 0 {
+			t.Tags = qualified[i]
+		}
+	}
+	return nil
 }
 
-func (c Config) ResolveTarget(name string, overrides map[string]map[string]Override) (*Target, error) {
-	t, err := c.target(name, map[string]*Target{}, overrides)
-	if err != nil {
+// ApplyOutputOverride sets out as the output of all the targets of c,
+// replacing their outputs and the push and load shorthands.
+func ApplyOutputOverride(c *Config, out string) {
+	for _, t := range c.Targets {
+		t.Outputs = []string{out}
+		t.Push = nil
+		t.Load = nil
+	}
+}
+
+// ApplyOutputOverridePreserving is like ApplyOutputOverride, but only the
+// image and registry outputs of the targets, inherited or not, are replaced
+// by out. Outputs of other types, like local or tar exports, are kept as an
+// explicit intent of the target. Targets without outputs get out.
+func ApplyOutputOverridePreserving(c *Config, out string) {
+	res := make([][]string, len(c.Targets))
+	for i, t := range c.Targets {
+		outputs := t.Outputs
+		if rt, err := c.target(t.Name, map[string]*Target{}, nil); err == nil {
+			// targets that cannot be resolved are reported when built
+			outputs = rt.Outputs
+		}
+		res[i] = make([]string, 0, len(outputs))
+		replaced := false
+		for _, o := range outputs {
+			switch parseOutputType(o) {
+			case "image", "registry":
+				if !replaced {
+					res[i] = append(res[i], out)
+					replaced = true
+				}
+			default:
+				res[i] = append(res[i], o)
+			}
+		}
+		if len(res[i]) == 0 {
+			res[i] = []string{out}
+		}
+	}
+	// outputs are only set once all of them are resolved, as targets
+	// inherit the outputs of each other
+	for i, t := range c.Targets {
+		t.Outputs = res[i]
+	}
+}
+
+// TargetsByBuilder groups the resolved targets m by the builder instance they
+// are pinned to. Targets not pinned to a builder are grouped under the empty
+// name, for the default builder.
+func TargetsByBuilder(m map[string]*Target) map[string]map[string]*Target {
+	res := map[string]map[string]*Target{}
+	for name, t := range m {
+		b := ""
+		if t.Builder != nil {
+			b = *t.Builder
+		}
+		if res[b] == nil {
+			res[b] = map[string]*Target{}
+		}
+		res[b][name] = t
+	}
+	return res
+}
+
+// BuildOptsByBuilder groups the build options bo of the resolved targets m by
+// the builder instance their target is pinned to. Targets not pinned to a
+// builder are grouped under the empty name, for the default builder. An error
+// is returned if a target uses a target pinned to another builder as named
+// context, as linked targets must be built by the same builder.
+func BuildOptsByBuilder(m map[string]*Target, bo map[string]build.Options) (map[string]map[string]build.Options, error) {
+	builder := func(name string) string {
+		if t, ok := m[name]; ok && t.Builder != nil {
+			return *t.Builder
+		}
+		return ""
+	}
+	res := map[string]map[string]build.Options{}
+	for name, opt := range bo {
+		b := builder(name)
+		if t, ok := m[name]; ok {
+			for _, v := range t.Contexts {
+				if link := strings.TrimPrefix(v, "target:"); link != v && builder(link) != b {
+					return nil, errors.Errorf("target %s cannot use target %s as named context as they are built by different builders", name, link)
+				}
+			}
+		}
+		if res[b] == nil {
+			res[b] = map[string]build.Options{}
+		}
+		res[b][name] = opt
+	}
+	return res, nil
+}
+
+// ApplyCacheOnly sets the cacheonly output on all the resolved targets of m,
+// replacing their outputs and disabling their push and load shorthands, so
+// they are built without exporting any result. Cache exports are kept.
+func ApplyCacheOnly(m map[string]*Target) {
+	for _, t := range m {
+		t.Outputs = []string{"type=cacheonly"}
+		t.Push = nil
+		t.Load = nil
+	}
+}
+
+func (t *Target) applyDefaults(d *Target) {
+	if t.Context == nil && d.Context != nil {
+		v := *d.Context
+		t.Context = &v
+	}
+	if t.Dockerfile == nil && d.Dockerfile != nil {
+		v := *d.Dockerfile
+		t.Dockerfile = &v
+	}
+	if t.DockerfileInline == nil && d.DockerfileInline != nil {
+		v := *d.DockerfileInline
+		t.DockerfileInline = &v
+	}
+	if len(t.Args) == 0 && len(d.Args) > 0 {
+		t.Args = copyMap(d.Args)
+	}
+	if len(t.Contexts) == 0 && len(d.Contexts) > 0 {
+		t.Contexts = copyMap(d.Contexts)
+	}
+	if len(t.Labels) == 0 && len(d.Labels) > 0 {
+		t.Labels = copyMap(d.Labels)
+	}
+	if len(t.Annotations) == 0 && len(d.Annotations) > 0 {
+		t.Annotations = copySlice(d.Annotations)
+	}
+	if len(t.Tags) == 0 && len(d.Tags) > 0 {
+		t.Tags = copySlice(d.Tags)
+	}
+	if len(t.CacheFrom) == 0 && len(d.CacheFrom) > 0 {
+		t.CacheFrom = copySlice(d.CacheFrom)
+	}
+	if len(t.CacheTo) == 0 && len(d.CacheTo) > 0 {
+		t.CacheTo = copySlice(d.CacheTo)
+	}
+	if t.Target == nil && d.Target != nil {
+		v := *d.Target
+		t.Target = &v
+	}
+	if len(t.Secrets) == 0 && len(d.Secrets) > 0 {
+		t.Secrets = copySlice(d.Secrets)
+	}
+	if len(t.SSH) == 0 && len(d.SSH) > 0 {
+		t.SSH = copySlice(d.SSH)
+	}
+	if len(t.Platforms) == 0 && len(d.Platforms) > 0 {
+		t.Platforms = copySlice(d.Platforms)
+	}
+	if len(t.Outputs) == 0 && len(d.Outputs) > 0 {
+		t.Outputs = copySlice(d.Outputs)
+	}
+	if t.Pull == nil && d.Pull != nil {
+		v := *d.Pull
+		t.Pull = &v
+	}
+	if t.NoCache == nil && d.NoCache != nil {
+		v := *d.NoCache
+		t.NoCache = &v
+	}
+	if t.Push == nil && d.Push != nil {
+		v := *d.Push
+		t.Push = &v
+	}
+	if t.Load == nil && d.Load != nil {
+		v := *d.Load
+		t.Load = &v
+	}
+	if t.NetworkMode == nil && d.NetworkMode != nil {
+		v := *d.NetworkMode
+		t.NetworkMode = &v
+	}
+	if len(t.NoCacheFilter) == 0 && len(d.NoCacheFilter) > 0 {
+		t.NoCacheFilter = copySlice(d.NoCacheFilter)
+	}
+	if len(t.ExtraHosts) == 0 && len(d.ExtraHosts) > 0 {
+		t.ExtraHosts = copySlice(d.ExtraHosts)
+	}
+	if t.ShmSize == nil && d.ShmSize != nil {
+		v := *d.ShmSize
+		t.ShmSize = &v
+	}
+	if len(t.Ulimits) == 0 && len(d.Ulimits) > 0 {
+		t.Ulimits = copySlice(d.Ulimits)
+	}
+	if len(t.Entitlements) == 0 && len(d.Entitlements) > 0 {
+		t.Entitlements = copySlice(d.Entitlements)
+	}
+	if t.Builder == nil && d.Builder != nil {
+		v := *d.Builder
+		t.Builder = &v
+	}
+	if t.Call == nil && d.Call != nil {
+		v := *d.Call
+		t.Call = &v
+	}
+}
+
+// Platforms returns the sorted union of the platforms of all targets,
+// including the ones set through inheritance. Targets that do not set any
+// platform do not contribute.
+func (c *Config) Platforms() []string {
+	return c.PlatformsWithDefault("")
+}
+
+// PlatformsWithDefault is like Platforms but targets that do not set any
+// platform contribute def, typically the host platform. An empty def is
+// ignored.
+func (c *Config) PlatformsWithDefault(def string) []string {
+	m := map[string]struct{}{}
+	for _, t := range c.Targets {
+		platforms := t.Platforms
+		if rt, err := c.ResolveTarget(t.Name, nil); err == nil {
+			platforms = rt.Platforms
+		}
+		if len(platforms) == 0 && def != "" {
+			platforms = []string{def}
+		}
+		for _, p := range splitPlatforms(platforms) {
+			if p != "" {
+				m[p] = struct{}{}
+			}
+		}
+	}
+	res := make([]string, 0, len(m))
+	for p := range m {
+		res = append(res, p)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (c Config) expandTargets(pattern string) ([]string, error) {
+	for _, target := range c.Targets {
+		if target.Name == pattern {
+			return []string{pattern}, nil
+		}
+	}
+	if c.hasGroup(pattern) {
+		return c.ResolveGroup(pattern), nil
+	}
+
+	var names []string
+	for _, target := range c.Targets {
+		ok, err := path.Match(pattern, target.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not match targets with '%s'", pattern)
+		}
+		if ok {
+			names = append(names, target.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.Errorf("could not find any target matching '%s'", pattern)
+	}
+	return names, nil
+}
+
+// expandTargetsAndGroups replaces the glob patterns of names with the sorted
+// names of the groups and targets they match. Names without glob characters
+// are kept as is, even if they don't match any group or target.
+func (c Config) expandTargetsAndGroups(names []string) ([]string, error) {
+	var res []string
+	for _, pattern := range names {
+		if !strings.ContainsAny(pattern, "*?[") {
+			res = append(res, pattern)
+			continue
+		}
+		var matches []string
+		for _, g := range c.Groups {
+			ok, err := path.Match(pattern, g.Name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not match targets with '%s'", pattern)
+			}
+			if ok {
+				matches = append(matches, g.Name)
+			}
+		}
+		for _, t := range c.Targets {
+			ok, err := path.Match(pattern, t.Name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not match targets with '%s'", pattern)
+			}
+			if ok {
+				matches = append(matches, t.Name)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("could not find any target or group matching '%s'", pattern)
+		}
+		sort.Strings(matches)
+		res = append(res, matches...)
+	}
+	return dedupString(res), nil
+}
+
+func (c Config) loadLinks(name string, t *Target, m map[string]*Target, o map[string]map[string]Override, visited []string) error {
+	visited = append(visited, name)
+	for _, v := range t.Contexts {
+		if strings.HasPrefix(v, "target:") {
+			target := strings.TrimPrefix(v, "target:")
+			if target == t.Name {
+				return errors.Errorf("target %s cannot link to itself", target)
+			}
+			for _, v := range visited {
+				if v == target {
+					return errors.Errorf("infinite loop from %s to %s", name, target)
+				}
+			}
+			t2, ok := m[target]
+			if !ok {
+				var err error
+				t2, err = c.ResolveTarget(target, o)
+				if err != nil {
+					return err
+				}
+				t2.Outputs = nil
+				t2.linked = true
+				m[target] = t2
+			}
+			if err := c.loadLinks(target, t2, m, o, visited); err != nil {
+				return err
+			}
+			if len(t.Platforms) > 1 && len(t2.Platforms) > 1 {
+				if !sliceEqual(t.Platforms, t2.Platforms) {
+					return errors.Errorf("target %s can't be used by %s because it is defined for different platforms %v and %v", target, name, t2.Platforms, t.Platforms)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c Config) newOverrides(v []string) (map[string]map[string]Override, error) {
+	m := map[string]map[string]Override{}
+	for _, v := range v {
+		parts := strings.SplitN(v, "=", 2)
+		keys := strings.SplitN(parts[0], ".", 3)
+		if len(keys) < 2 {
+			return nil, errors.Errorf("invalid override key %s, expected target.name", parts[0])
+		}
+
+		pattern := keys[0]
+		if len(parts) != 2 && keys[1] != "args" {
+			return nil, errors.Errorf("invalid override %s, expected target.name=value", v)
+		}
+
+		names, err := c.expandTargets(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		kk := strings.SplitN(parts[0], ".", 2)
+
+		for _, name := range names {
+			t, ok := m[name]
+			if !ok {
+				t = map[string]Override{}
+				m[name] = t
+			}
+
+			o := t[kk[1]]
+
+			switch keys[1] {
+			case "output", "cache-to", "cache-from", "tags", "platform", "secrets", "ssh", "annotations", "add-hosts", "ulimits", "entitlements":
+				if len(parts) == 2 {
+					o.ArrValue = append(o.ArrValue, parts[1])
+				}
+			case "args":
+				if len(keys) != 3 {
+					return nil, errors.Errorf("invalid key %s, args requires name", parts[0])
+				}
+				if keys[2] == "@" {
+					// args read from an env file, see AddOverrides
+					if len(parts) != 2 {
+						return nil, errors.Errorf("invalid override %s, expected target.args.@=file", v)
+					}
+					o.ArrValue = append(o.ArrValue, parts[1])
+					break
+				}
+				if len(parts) < 2 {
+					v, ok := os.LookupEnv(keys[2])
+					if !ok {
+						continue
+					}
+					o.Value = v
+				}
+				fallthrough
+			case "contexts":
+				if len(keys) != 3 {
+					return nil, errors.Errorf("invalid key %s, contexts requires name", parts[0])
+				}
+				fallthrough
+			default:
+				if len(parts) == 2 {
+					o.Value = parts[1]
+				}
+			}
+
+			t[kk[1]] = o
+		}
+	}
+	return m, nil
+}
+
+// validateGroupCycles returns an error listing the path of the first cycle
+// found in the references between the groups of c reachable from names.
+// Cycles in groups that are not requested don't prevent building. A reference
+// to a group being resolved that is also the name of a target refers to the
+// target.
+func (c Config) validateGroupCycles(names []string) error {
+	groups := make(map[string]*Group, len(c.Groups))
+	for _, g := range c.Groups {
+		groups[g.Name] = g
+	}
+	targets := make(map[string]struct{}, len(c.Targets))
+	for _, t := range c.Targets {
+		targets[t.Name] = struct{}{}
+	}
+	done := map[string]struct{}{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		for i, p := range path {
+			if p == name {
+				if _, ok := targets[name]; ok {
+					return nil
+				}
+				return errors.Errorf("cyclic group reference: %s", strings.Join(append(path[i:], name), " -> "))
+			}
+		}
+		g, ok := groups[name]
+		if !ok {
+			return nil
+		}
+		if _, ok := done[name]; ok {
+			return nil
+		}
+		path = append(path, name)
+		for _, t := range g.Targets {
+			if err := visit(t, path); err != nil {
+				return err
+			}
+		}
+		done[name] = struct{}{}
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Config) hasGroup(name string) bool {
+	for _, g := range c.Groups {
+		if g.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) ResolveGroup(name string) []string {
+	return dedupString(c.group(name, map[string][]string{}))
+}
+
+func (c Config) group(name string, visited map[string][]string) []string {
+	if _, ok := visited[name]; ok {
+		return visited[name]
+	}
+	var g *Group
+	for _, group := range c.Groups {
+		if group.Name == name {
+			g = group
+			break
+		}
+	}
+	if g == nil {
+		return []string{name}
+	}
+	visited[name] = []string{}
+	targets := make([]string, 0, len(g.Targets))
+	for _, t := range g.Targets {
+		tgroup := c.group(t, visited)
+		if len(tgroup) > 0 {
+			targets = append(targets, tgroup...)
+		} else {
+			targets = append(targets, t)
+		}
+	}
+	visited[name] = targets
+	return targets
+}
+
+func (c Config) ResolveTarget(name string, overrides map[string]map[string]Override) (*Target, error) {
+	t, err := c.target(name, map[string]*Target{}, overrides)
+	if err != nil {
 		return nil, err
 	}
 	t.Inherits = nil
@@ -454,257 +1284,1049 @@ func (c Config) ResolveTarget(name string, overrides map[string]map[string]Overr
 		s := "."
 		t.Context = &s
 	}
-	if t.Dockerfile == nil {
+	if t.Dockerfile == nil && t.DockerfileInline == nil {
 		s := "Dockerfile"
 		t.Dockerfile = &s
 	}
-	return t, nil
+	t.Platforms = dedupePlatforms(t.Platforms)
+	if err := t.expandOutputs(); err != nil {
+		return nil, errors.Wrapf(err, "target %s", name)
+	}
+	return t, nil
+}
+
+func (c Config) target(name string, visited map[string]*Target, overrides map[string]map[string]Override) (*Target, error) {
+	if t, ok := visited[name]; ok {
+		return t, nil
+	}
+	visited[name] = nil
+	var t *Target
+	for _, target := range c.Targets {
+		if target.Name == name {
+			t = target
+			break
+		}
+	}
+	if t == nil {
+		return nil, errors.Errorf("failed to find target %s", name)
+	}
+	tt := &Target{}
+	for _, name := range t.Inherits {
+		t, err := c.target(name, visited, overrides)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			tt.Merge(t)
+		}
+	}
+	m := defaultTarget()
+	m.Merge(tt)
+	m.Merge(t)
+	tt = m
+	if err := tt.AddOverrides(overrides[name]); err != nil {
+		return nil, err
+	}
+	tt.normalize()
+	visited[name] = tt
+	return tt, nil
+}
+
+type Group struct {
+	Name        string   `json:"-" hcl:"name,label"`
+	Description *string  `json:"description,omitempty" hcl:"description,optional"`
+	Targets     []string `json:"targets" hcl:"targets"`
+	// Target // TODO?
+}
+
+type Target struct {
+	Name string `json:"-" hcl:"name,label"`
+
+	// Description is informational only, listed by ListTargets
+	Description *string `json:"description,omitempty" hcl:"description,optional"`
+
+	// Inherits is the only field that cannot be overridden with --set
+	Inherits []string `json:"inherits,omitempty" hcl:"inherits,optional"`
+
+	Context          *string           `json:"context,omitempty" hcl:"context,optional"`
+	Contexts         map[string]string `json:"contexts,omitempty" hcl:"contexts,optional"`
+	Dockerfile       *string           `json:"dockerfile,omitempty" hcl:"dockerfile,optional"`
+	DockerfileInline *string           `json:"dockerfile-inline,omitempty" hcl:"dockerfile-inline,optional"`
+	Args             map[string]string `json:"args,omitempty" hcl:"args,optional"`
+	Labels           map[string]string `json:"labels,omitempty" hcl:"labels,optional"`
+	Annotations      []string          `json:"annotations,omitempty" hcl:"annotations,optional"`
+	Tags             []string          `json:"tags,omitempty" hcl:"tags,optional"`
+	CacheFrom        []string          `json:"cache-from,omitempty"  hcl:"cache-from,optional"`
+	CacheTo          []string          `json:"cache-to,omitempty"  hcl:"cache-to,optional"`
+	Target           *string           `json:"target,omitempty" hcl:"target,optional"`
+	Secrets          []string          `json:"secret,omitempty" hcl:"secret,optional"`
+	SSH              []string          `json:"ssh,omitempty" hcl:"ssh,optional"`
+	Platforms        []string          `json:"platforms,omitempty" hcl:"platforms,optional"`
+	Outputs          []string          `json:"output,omitempty" hcl:"output,optional"`
+	Pull             *bool             `json:"pull,omitempty" hcl:"pull,optional"`
+	NoCache          *bool             `json:"no-cache,omitempty" hcl:"no-cache,optional"`
+	Push             *bool             `json:"push,omitempty" hcl:"push,optional"`
+	Load             *bool             `json:"load,omitempty" hcl:"load,optional"`
+	NetworkMode      *string           `json:"-" hcl:"-"`
+	NoCacheFilter    []string          `json:"no-cache-filter,omitempty" hcl:"no-cache-filter,optional"`
+	ExtraHosts       []string          `json:"add-hosts,omitempty" hcl:"add-hosts,optional"`
+	ShmSize          *string           `json:"shm-size,omitempty" hcl:"shm-size,optional"`
+	Ulimits          []string          `json:"ulimits,omitempty" hcl:"ulimits,optional"`
+	Builder          *string           `json:"builder,omitempty" hcl:"builder,optional"`
+	Entitlements     []string          `json:"entitlements,omitempty" hcl:"entitlements,optional"`
+	Call             *string           `json:"call,omitempty" hcl:"call,optional"`
+	// IMPORTANT: if you add more fields here, do not forget to update newOverrides and docs/guides/bake/file-definition.md.
+	// The order of the fields defines the order of the keys when printing targets.
+
+	// ArgsOrder holds the names of the args in the order they are defined in
+	// a compose file. It may not list all args of a merged target.
+	ArgsOrder []string `json:"-"`
+
+	// linked is a private field to mark a target used as a linked one
+	linked bool
+}
+
+// clone returns a copy of t that doesn't share any slice, map or pointer
+// with it.
+func (t *Target) clone() *Target {
+	t2 := *t
+	v := reflect.ValueOf(&t2).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Ptr:
+			if !f.IsNil() {
+				p := reflect.New(f.Type().Elem())
+				p.Elem().Set(f.Elem())
+				f.Set(p)
+			}
+		case reflect.Slice:
+			if !f.IsNil() {
+				f.Set(reflect.AppendSlice(reflect.MakeSlice(f.Type(), 0, f.Len()), f))
+			}
+		case reflect.Map:
+			if !f.IsNil() {
+				m := reflect.MakeMapWithSize(f.Type(), f.Len())
+				for it := f.MapRange(); it.Next(); {
+					m.SetMapIndex(it.Key(), it.Value())
+				}
+				f.Set(m)
+			}
+		}
+	}
+	return &t2
+}
+
+func (t *Target) normalize() {
+	t.Tags = removeDupes(t.Tags)
+	t.Secrets = removeDupes(t.Secrets)
+	t.SSH = removeDupes(t.SSH)
+	t.Platforms = removeDupes(splitPlatforms(t.Platforms))
+	t.CacheFrom = removeDupes(t.CacheFrom)
+	t.CacheTo = removeDupes(t.CacheTo)
+	t.Outputs = removeDupes(t.Outputs)
+	t.ExtraHosts = removeDupes(t.ExtraHosts)
+	t.NoCacheFilter = removeDupes(t.NoCacheFilter)
+	t.Annotations = removeDupes(t.Annotations)
+	t.Entitlements = removeDupes(t.Entitlements)
+
+	for k, v := range t.Contexts {
+		if v == "" {
+			delete(t.Contexts, k)
+		}
+	}
+	if len(t.Contexts) == 0 {
+		t.Contexts = nil
+	}
+}
+
+// MergePolicy controls how fields set on both targets are handled when
+// merging them.
+type MergePolicy int
+
+const (
+	// MergeLastWins replaces the values of the fields that are not merged
+	// with the ones of the target merged last. This is the default policy.
+	MergeLastWins MergePolicy = iota
+	// MergeError returns an error if both targets set a field to different
+	// values. The description is informational only and the last one wins.
+	MergeError
+	// MergeDeep appends the values of list fields that are otherwise
+	// replaced, like tags, platforms, cache-to and output.
+	MergeDeep
+)
+
+func (t *Target) Merge(t2 *Target) {
+	_ = t.MergeWithPolicy(t2, MergeLastWins)
+}
+
+// MergeWithPolicy merges t2 into t using the provided policy for the fields
+// set on both targets.
+func (t *Target) MergeWithPolicy(t2 *Target, policy MergePolicy) error {
+	if policy == MergeError {
+		if err := t.checkMergeConflicts(t2); err != nil {
+			return err
+		}
+	}
+	if t2.Description != nil {
+		t.Description = t2.Description
+	}
+	if t2.Context != nil {
+		t.Context = t2.Context
+	}
+	if t2.Dockerfile != nil {
+		t.Dockerfile = t2.Dockerfile
+	}
+	if t2.DockerfileInline != nil {
+		t.DockerfileInline = t2.DockerfileInline
+	}
+	for k, v := range t2.Args {
+		if t.Args == nil {
+			t.Args = map[string]string{}
+		}
+		t.Args[k] = v
+	}
+	for _, k := range t2.ArgsOrder {
+		if !sliceContains(t.ArgsOrder, k) {
+			t.ArgsOrder = append(t.ArgsOrder, k)
+		}
+	}
+	for k, v := range t2.Contexts {
+		if t.Contexts == nil {
+			t.Contexts = map[string]string{}
+		}
+		t.Contexts[k] = v
+	}
+	for k, v := range t2.Labels {
+		if t.Labels == nil {
+			t.Labels = map[string]string{}
+		}
+		t.Labels[k] = v
+	}
+	if t2.Annotations != nil { // merge by key
+		t.Annotations = mergeAnnotations(t.Annotations, t2.Annotations)
+	}
+	if t2.Tags != nil { // no merge
+		tags := resetList(&t.Tags, t2.Tags)
+		t.Tags = mergeList(t.Tags, tags, policy)
+	}
+	if t2.Target != nil {
+		t.Target = t2.Target
+	}
+	if t2.Secrets != nil { // merge
+		secrets := resetList(&t.Secrets, t2.Secrets)
+		t.Secrets = append(t.Secrets, secrets...)
+	}
+	if t2.SSH != nil { // merge
+		ssh := resetList(&t.SSH, t2.SSH)
+		t.SSH = append(t.SSH, ssh...)
+	}
+	if t2.Platforms != nil { // no merge
+		platforms := resetList(&t.Platforms, t2.Platforms)
+		t.Platforms = mergeList(t.Platforms, platforms, policy)
+	}
+	if t2.CacheFrom != nil { // merge
+		cacheFrom := resetList(&t.CacheFrom, t2.CacheFrom)
+		t.CacheFrom = append(t.CacheFrom, cacheFrom...)
+	}
+	if t2.CacheTo != nil { // no merge
+		cacheTo := resetList(&t.CacheTo, t2.CacheTo)
+		t.CacheTo = mergeList(t.CacheTo, cacheTo, policy)
+	}
+	if t2.Outputs != nil { // no merge
+		t.Outputs = mergeList(t.Outputs, t2.Outputs, policy)
+	}
+	if t2.Pull != nil {
+		t.Pull = t2.Pull
+	}
+	if t2.NoCache != nil {
+		t.NoCache = t2.NoCache
+	}
+	if t2.Push != nil {
+		t.Push = t2.Push
+	}
+	if t2.Load != nil {
+		t.Load = t2.Load
+	}
+	if t2.NetworkMode != nil {
+		t.NetworkMode = t2.NetworkMode
+	}
+	if t2.NoCacheFilter != nil { // merge
+		t.NoCacheFilter = append(t.NoCacheFilter, t2.NoCacheFilter...)
+	}
+	if t2.ExtraHosts != nil { // merge
+		t.ExtraHosts = append(t.ExtraHosts, t2.ExtraHosts...)
+	}
+	if t2.ShmSize != nil {
+		t.ShmSize = t2.ShmSize
+	}
+	if t2.Ulimits != nil { // merge
+		t.Ulimits = append(t.Ulimits, t2.Ulimits...)
+	}
+	if t2.Builder != nil {
+		t.Builder = t2.Builder
+	}
+	if t2.Entitlements != nil { // merge
+		t.Entitlements = append(t.Entitlements, t2.Entitlements...)
+	}
+	if t2.Call != nil {
+		t.Call = t2.Call
+	}
+	t.Inherits = append(t.Inherits, t2.Inherits...)
+	return nil
+}
+
+func (t *Target) checkMergeConflicts(t2 *Target) error {
+	for _, f := range []struct {
+		name   string
+		v1, v2 *string
+	}{
+		{"context", t.Context, t2.Context},
+		{"dockerfile", t.Dockerfile, t2.Dockerfile},
+		{"dockerfile-inline", t.DockerfileInline, t2.DockerfileInline},
+		{"target", t.Target, t2.Target},
+		{"network", t.NetworkMode, t2.NetworkMode},
+		{"shm-size", t.ShmSize, t2.ShmSize},
+		{"builder", t.Builder, t2.Builder},
+		{"call", t.Call, t2.Call},
+	} {
+		if f.v1 != nil && f.v2 != nil && *f.v1 != *f.v2 {
+			return errors.Errorf("conflicting values for %s in target %s: %q and %q", f.name, t2.Name, *f.v1, *f.v2)
+		}
+	}
+	for _, f := range []struct {
+		name   string
+		v1, v2 *bool
+	}{
+		{"pull", t.Pull, t2.Pull},
+		{"no-cache", t.NoCache, t2.NoCache},
+		{"push", t.Push, t2.Push},
+		{"load", t.Load, t2.Load},
+	} {
+		if f.v1 != nil && f.v2 != nil && *f.v1 != *f.v2 {
+			return errors.Errorf("conflicting values for %s in target %s: %t and %t", f.name, t2.Name, *f.v1, *f.v2)
+		}
+	}
+	for _, f := range []struct {
+		name   string
+		m1, m2 map[string]string
+	}{
+		{"args", t.Args, t2.Args},
+		{"contexts", t.Contexts, t2.Contexts},
+		{"labels", t.Labels, t2.Labels},
+	} {
+		for k, v2 := range f.m2 {
+			if v1, ok := f.m1[k]; ok && v1 != v2 {
+				return errors.Errorf("conflicting values for %s.%s in target %s: %q and %q", f.name, k, t2.Name, v1, v2)
+			}
+		}
+	}
+	for _, f := range []struct {
+		name   string
+		s1, s2 []string
+	}{
+		{"tags", t.Tags, t2.Tags},
+		{"platforms", t.Platforms, t2.Platforms},
+		{"cache-to", t.CacheTo, t2.CacheTo},
+		{"output", t.Outputs, t2.Outputs},
+	} {
+		if f.s1 != nil && f.s2 != nil && !stringsEqual(f.s1, f.s2) {
+			return errors.Errorf("conflicting values for %s in target %s: %v and %v", f.name, t2.Name, f.s1, f.s2)
+		}
+	}
+	return nil
+}
+
+// resetList clears s1 if s2 holds the !reset sentinel, and returns the
+// entries of s2 following the last sentinel. s2 is returned as is otherwise.
+func resetList(s1 *[]string, s2 []string) []string {
+	for i := len(s2) - 1; i >= 0; i-- {
+		if s2[i] == resetSentinel {
+			*s1 = nil
+			return copySlice(s2[i+1:])
+		}
+	}
+	return s2
+}
+
+// mergeAnnotations returns the union of the annotations of s1 and s2. An
+// annotation of s2 replaces the one of s1 with the same key.
+func mergeAnnotations(s1, s2 []string) []string {
+	keys := make(map[string]struct{}, len(s2))
+	for _, v := range s2 {
+		keys[strings.SplitN(v, "=", 2)[0]] = struct{}{}
+	}
+	res := make([]string, 0, len(s1)+len(s2))
+	for _, v := range s1 {
+		if _, ok := keys[strings.SplitN(v, "=", 2)[0]]; !ok {
+			res = append(res, v)
+		}
+	}
+	return append(res, s2...)
+}
+
+func mergeList(s1, s2 []string, policy MergePolicy) []string {
+	if policy == MergeDeep {
+		return append(s1, s2...)
+	}
+	return s2
+}
+
+func (t *Target) AddOverrides(overrides map[string]Override) error {
+	for key, o := range overrides {
+		value := o.Value
+		keys := strings.SplitN(key, ".", 2)
+		switch keys[0] {
+		case "context":
+			t.Context = &value
+		case "dockerfile":
+			t.Dockerfile = &value
+		case "args":
+			if len(keys) != 2 {
+				return errors.Errorf("args require name")
+			}
+			if t.Args == nil {
+				t.Args = map[string]string{}
+			}
+			if keys[1] == "@" {
+				for _, fn := range o.ArrValue {
+					env, err := dotenv.Read(fn)
+					if err != nil {
+						return errors.Wrapf(err, "failed to read args file %s", fn)
+					}
+					for k, v := range env {
+						// args set explicitly take precedence over the file
+						if _, ok := overrides["args."+k]; !ok {
+							t.Args[k] = v
+						}
+					}
+				}
+				continue
+			}
+			t.Args[keys[1]] = value
+		case "contexts":
+			if len(keys) != 2 {
+				return errors.Errorf("contexts require name")
+			}
+			if t.Contexts == nil {
+				t.Contexts = map[string]string{}
+			}
+			t.Contexts[keys[1]] = value
+		case "labels":
+			if len(keys) != 2 {
+				return errors.Errorf("labels require name")
+			}
+			if t.Labels == nil {
+				t.Labels = map[string]string{}
+			}
+			t.Labels[keys[1]] = value
+		case "annotations":
+			t.Annotations = o.ArrValue
+		case "tags":
+			t.Tags = o.ArrValue
+		case "cache-from":
+			t.CacheFrom = o.ArrValue
+		case "cache-to":
+			t.CacheTo = o.ArrValue
+		case "target":
+			t.Target = &value
+		case "secrets":
+			t.Secrets = o.ArrValue
+		case "ssh":
+			t.SSH = o.ArrValue
+		case "platform":
+			t.Platforms = o.ArrValue
+		case "output":
+			t.Outputs = o.ArrValue
+		case "no-cache":
+			noCache, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Errorf("invalid value %s for boolean key no-cache", value)
+			}
+			t.NoCache = &noCache
+		case "no-cache-filter":
+			t.NoCacheFilter = o.ArrValue
+		case "add-hosts":
+			t.ExtraHosts = o.ArrValue
+		case "shm-size":
+			t.ShmSize = &value
+		case "ulimits":
+			t.Ulimits = o.ArrValue
+		case "builder":
+			t.Builder = &value
+		case "entitlements":
+			t.Entitlements = o.ArrValue
+		case "call":
+			t.Call = &value
+		case "pull":
+			pull, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Errorf("invalid value %s for boolean key pull", value)
+			}
+			t.Pull = &pull
+		case "push":
+			push, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Errorf("invalid value %s for boolean key push", value)
+			}
+			t.Push = &push
+			if _, ok := overrides["load"]; push && !ok {
+				// pushing from the command line wins over load set in the file
+				t.Load = nil
+			}
+		case "load":
+			load, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Errorf("invalid value %s for boolean key load", value)
+			}
+			t.Load = &load
+			if _, ok := overrides["push"]; load && !ok {
+				// loading from the command line wins over push set in the file
+				t.Push = nil
+			}
+		default:
+			return errors.Errorf("unknown key: %s", keys[0])
+		}
+	}
+	return nil
 }
 
-func (c Config) target(name string, visited map[string]*Target, overrides map[string]map[string]Override) (*Target, error) {
-	if t, ok := visited[name]; ok {
-		return t, nil
+// expandOutputs sets up the outputs matching the push and load shorthands
+// of the target. An explicit push = false is set on the image and registry
+// outputs that don't set push.
+func (t *Target) expandOutputs() error {
+	push := t.Push != nil && *t.Push
+	load := t.Load != nil && *t.Load
+	if push && load {
+		return errors.Errorf("push and load may not be set together at the moment")
 	}
-	visited[name] = nil
-	var t *Target
-	for _, target := range c.Targets {
-		if target.Name == name {
-			t = target
-			break
-		}
+	if load {
+		return t.expandLoad()
 	}
-	if t == nil {
-		return nil, errors.Errorf("failed to find target %s", name)
+	if t.Push == nil || len(t.Outputs) == 0 && !push {
+		return nil
 	}
-	tt := &Target{}
-	for _, name := range t.Inherits {
-		t, err := c.target(name, visited, overrides)
-		if err != nil {
-			return nil, err
+	if len(t.Outputs) == 0 {
+		t.Outputs = []string{"type=image,push=true"}
+		return nil
+	}
+	// outputs can be shared with the targets inherited from
+	outputs := copySlice(t.Outputs)
+	for i, output := range outputs {
+		typ := parseOutputType(output)
+		if !push {
+			if _, ok := parseOutputAttr(output, "push"); !ok && (typ == "image" || typ == "registry") {
+				outputs[i] = output + ",push=false"
+			}
+			continue
 		}
-		if t != nil {
-			tt.Merge(t)
+		switch typ {
+		case "registry":
+		case "image":
+			if v, ok := parseOutputAttr(output, "push"); !ok {
+				outputs[i] = output + ",push=true"
+			} else if push, _ := strconv.ParseBool(v); !push {
+				return errors.Errorf("push conflicts with output %s", output)
+			}
+		default:
+			return errors.Errorf("push conflicts with output %s", output)
 		}
 	}
-	m := defaultTarget()
-	m.Merge(tt)
-	m.Merge(t)
-	tt = m
-	if err := tt.AddOverrides(overrides[name]); err != nil {
-		return nil, err
+	t.Outputs = outputs
+	return nil
+}
+
+func (t *Target) expandLoad() error {
+	if len(t.Platforms) > 1 {
+		return errors.Errorf("load is not supported for multiple platforms %v", t.Platforms)
 	}
-	tt.normalize()
-	visited[name] = tt
-	return tt, nil
+	if len(t.Outputs) == 0 {
+		t.Outputs = []string{"type=docker"}
+		return nil
+	}
+	for _, output := range t.Outputs {
+		if parseOutputType(output) != "docker" {
+			return errors.Errorf("load conflicts with output %s", output)
+		}
+	}
+	return nil
 }
 
-type Group struct {
-	Name    string   `json:"-" hcl:"name,label"`
-	Targets []string `json:"targets" hcl:"targets"`
-	// Target // TODO?
+// validate checks the resolved target name, expanding the shorthands of its
+// fields.
+func (t *Target) validate(name string) error {
+	if t.Dockerfile != nil && t.DockerfileInline != nil {
+		return errors.Errorf("target %s: dockerfile and dockerfile-inline are mutually exclusive, remove one of them", name)
+	}
+	if err := t.validateOutputs(name); err != nil {
+		return err
+	}
+	if err := t.validateInlineStage(name); err != nil {
+		return err
+	}
+	if err := t.expandCacheShorthands(name); err != nil {
+		return err
+	}
+	if _, err := buildflags.ParseEntitlements(t.Entitlements); err != nil {
+		return errors.Wrapf(err, "target %s", name)
+	}
+	if _, err := t.callFunc(); err != nil {
+		return errors.Wrapf(err, "target %s", name)
+	}
+	return t.validateKnownArgs(name)
 }
 
-type Target struct {
-	Name string `json:"-" hcl:"name,label"`
+// callFuncs maps the supported values of the call field to the frontend
+// method they run, build being the default.
+var callFuncs = map[string]string{
+	"build":   "",
+	"check":   "lint",
+	"outline": "outline",
+	"targets": "targets",
+}
 
-	// Inherits is the only field that cannot be overridden with --set
-	Inherits []string `json:"inherits,omitempty" hcl:"inherits,optional"`
+// callFunc returns the frontend method run by the call of the target, or an
+// empty string to build it.
+func (t *Target) callFunc() (string, error) {
+	if t.Call == nil {
+		return "", nil
+	}
+	fn, ok := callFuncs[*t.Call]
+	if !ok {
+		return "", errors.Errorf("invalid call %q, expected one of build, check, outline or targets", *t.Call)
+	}
+	return fn, nil
+}
 
-	Context          *string           `json:"context,omitempty" hcl:"context,optional"`
-	Contexts         map[string]string `json:"contexts,omitempty" hcl:"contexts,optional"`
-	Dockerfile       *string           `json:"dockerfile,omitempty" hcl:"dockerfile,optional"`
-	DockerfileInline *string           `json:"dockerfile-inline,omitempty" hcl:"dockerfile-inline,optional"`
-	Args             map[string]string `json:"args,omitempty" hcl:"args,optional"`
-	Labels           map[string]string `json:"labels,omitempty" hcl:"labels,optional"`
-	Tags             []string          `json:"tags,omitempty" hcl:"tags,optional"`
-	CacheFrom        []string          `json:"cache-from,omitempty"  hcl:"cache-from,optional"`
-	CacheTo          []string          `json:"cache-to,omitempty"  hcl:"cache-to,optional"`
-	Target           *string           `json:"target,omitempty" hcl:"target,optional"`
-	Secrets          []string          `json:"secret,omitempty" hcl:"secret,optional"`
-	SSH              []string          `json:"ssh,omitempty" hcl:"ssh,optional"`
-	Platforms        []string          `json:"platforms,omitempty" hcl:"platforms,optional"`
-	Outputs          []string          `json:"output,omitempty" hcl:"output,optional"`
-	Pull             *bool             `json:"pull,omitempty" hcl:"pull,optional"`
-	NoCache          *bool             `json:"no-cache,omitempty" hcl:"no-cache,optional"`
-	NetworkMode      *string           `json:"-" hcl:"-"`
-	NoCacheFilter    []string          `json:"no-cache-filter,omitempty" hcl:"no-cache-filter,optional"`
-	// IMPORTANT: if you add more fields here, do not forget to update newOverrides and docs/guides/bake/file-definition.md.
+// validateOutputs checks that the outputs of the target can handle the
+// number of platforms it is built for.
+func (t *Target) validateOutputs(name string) error {
+	if len(t.Platforms) < 2 {
+		return nil
+	}
+	for _, output := range t.Outputs {
+		if parseOutputType(output) == "docker" {
+			return errors.Errorf("target %s: docker exporter does not support multiple platforms %v, use oci or registry output instead", name, t.Platforms)
+		}
+	}
+	return nil
+}
 
-	// linked is a private field to mark a target used as a linked one
-	linked bool
+// validatePlatformOutputs checks that the outputs of the resolved target name,
+// and its load shorthand, support the platforms it is built for, once they
+// changed after resolving it.
+func (t *Target) validatePlatformOutputs(name string) error {
+	if t.Load != nil && *t.Load && len(t.Platforms) > 1 {
+		return errors.Errorf("target %s: load is not supported for multiple platforms %v", name, t.Platforms)
+	}
+	return t.validateOutputs(name)
 }
 
-func (t *Target) normalize() {
-	t.Tags = removeDupes(t.Tags)
-	t.Secrets = removeDupes(t.Secrets)
-	t.SSH = removeDupes(t.SSH)
-	t.Platforms = removeDupes(t.Platforms)
-	t.CacheFrom = removeDupes(t.CacheFrom)
-	t.CacheTo = removeDupes(t.CacheTo)
-	t.Outputs = removeDupes(t.Outputs)
-	t.NoCacheFilter = removeDupes(t.NoCacheFilter)
+// expandCacheShorthands expands the s3:// shorthands of the cache-from and
+// cache-to entries of target name.
+func (t *Target) expandCacheShorthands(name string) error {
+	cacheFrom, err := expandCacheShorthand(t.CacheFrom)
+	if err != nil {
+		return errors.Wrapf(err, "target %s", name)
+	}
+	cacheTo, err := expandCacheShorthand(t.CacheTo)
+	if err != nil {
+		return errors.Wrapf(err, "target %s", name)
+	}
+	t.CacheFrom, t.CacheTo = cacheFrom, cacheTo
+	return nil
+}
 
-	for k, v := range t.Contexts {
+// validateKnownArgs checks that the well-known build args of target name
+// have values of the type expected by the frontend.
+func (t *Target) validateKnownArgs(name string) error {
+	for k, v := range t.Args {
 		if v == "" {
-			delete(t.Contexts, k)
+			// unset values are ignored by the frontend
+			continue
+		}
+		var err error
+		switch knownArgTypes[k] {
+		case "bool":
+			_, err = strconv.ParseBool(v)
+		case "int":
+			_, err = strconv.ParseInt(v, 10, 64)
+		default:
+			continue
+		}
+		if err != nil {
+			return errors.Errorf("target %s: invalid value %q for build arg %s, expected %s", name, v, k, knownArgTypes[k])
 		}
 	}
-	if len(t.Contexts) == 0 {
-		t.Contexts = nil
+	return nil
+}
+
+// validateSecretIDs checks that every secret of target name has a unique
+// non-empty id, so the build can tell them apart.
+func validateSecretIDs(name string, secrets []string) error {
+	ids := map[string]struct{}{}
+	for _, s := range secrets {
+		id, _ := parseOutputAttr(s, "id")
+		if id == "" {
+			return errors.Errorf("target %s: secret %s has no id", name, s)
+		}
+		if _, ok := ids[id]; ok {
+			return errors.Errorf("target %s: duplicate secret id %s", name, id)
+		}
+		ids[id] = struct{}{}
 	}
+	return nil
 }
 
-func (t *Target) Merge(t2 *Target) {
-	if t2.Context != nil {
-		t.Context = t2.Context
+// validateInlineStage checks that the build stage of the target is declared
+// by its inline dockerfile, as its content is already known.
+func (t *Target) validateInlineStage(name string) error {
+	if t.DockerfileInline == nil || t.Target == nil || *t.Target == "" {
+		return nil
 	}
-	if t2.Dockerfile != nil {
-		t.Dockerfile = t2.Dockerfile
+	for _, m := range dockerfileStagePattern.FindAllStringSubmatch(*t.DockerfileInline, -1) {
+		// stage names are case-insensitive
+		if strings.EqualFold(m[1], *t.Target) {
+			return nil
+		}
 	}
-	if t2.DockerfileInline != nil {
-		t.DockerfileInline = t2.DockerfileInline
+	return errors.Errorf("target %s: stage %q not found in inline dockerfile", name, *t.Target)
+}
+
+// WillPush returns true if one of the target outputs pushes the result to a
+// registry.
+func (t *Target) WillPush() bool {
+	for _, output := range t.Outputs {
+		csvReader := csv.NewReader(strings.NewReader(output))
+		fields, err := csvReader.Read()
+		if err != nil {
+			continue
+		}
+		for _, field := range fields {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "type":
+				if parts[1] == "registry" {
+					return true
+				}
+			case "push":
+				if push, _ := strconv.ParseBool(parts[1]); push {
+					return true
+				}
+			}
+		}
 	}
-	for k, v := range t2.Args {
-		if t.Args == nil {
-			t.Args = map[string]string{}
+	return false
+}
+
+// MaskArgs returns a copy of the targets where the values of the build args
+// with a name matching re are masked. Targets are left untouched.
+func MaskArgs(m map[string]*Target, re *regexp.Regexp) map[string]*Target {
+	m2 := make(map[string]*Target, len(m))
+	for k, t := range m {
+		t2 := *t
+		if len(t.Args) > 0 {
+			t2.Args = make(map[string]string, len(t.Args))
+			for name, value := range t.Args {
+				if re.MatchString(name) {
+					value = maskedValue
+				}
+				t2.Args[name] = value
+			}
 		}
-		t.Args[k] = v
+		m2[k] = &t2
 	}
-	for k, v := range t2.Contexts {
-		if t.Contexts == nil {
-			t.Contexts = map[string]string{}
+	return m2
+}
+
+// ValidateDockerfiles checks that the dockerfile of each target exists in its
+// local build context. Targets with a remote context or an inline dockerfile
+// are skipped.
+func ValidateDockerfiles(m map[string]*Target) error {
+	for name, t := range m {
+		if err := t.validateDockerfile(name); err != nil {
+			return err
 		}
-		t.Contexts[k] = v
 	}
-	for k, v := range t2.Labels {
-		if t.Labels == nil {
-			t.Labels = map[string]string{}
+	return nil
+}
+
+func (t *Target) validateDockerfile(name string) error {
+	if t.DockerfileInline != nil {
+		return nil
+	}
+	dockerfilePath, contextPath, ok, err := t.localDockerfilePath()
+	if err != nil || !ok {
+		return err
+	}
+	if _, err := os.Stat(dockerfilePath); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("target %s: dockerfile not found at %s (context %s)", name, dockerfilePath, contextPath)
 		}
-		t.Labels[k] = v
+		return errors.Wrapf(err, "target %s: failed to stat dockerfile", name)
+	}
+	return nil
+}
+
+// localDockerfilePath returns the absolute path of the dockerfile of the
+// target along with its context path. It returns false if the context or the
+// dockerfile is not local.
+func (t *Target) localDockerfilePath() (string, string, bool, error) {
+	contextPath := "."
+	if t.Context != nil {
+		contextPath = strings.TrimPrefix(*t.Context, "cwd://")
 	}
-	if t2.Tags != nil { // no merge
-		t.Tags = t2.Tags
+	if contextPath == "-" || IsRemoteURL(contextPath) {
+		return "", "", false, nil
 	}
-	if t2.Target != nil {
-		t.Target = t2.Target
+	dockerfilePath := "Dockerfile"
+	if t.Dockerfile != nil {
+		dockerfilePath = *t.Dockerfile
 	}
-	if t2.Secrets != nil { // merge
-		t.Secrets = append(t.Secrets, t2.Secrets...)
+	if dockerfilePath == "-" || isRemoteResource(dockerfilePath) {
+		return "", "", false, nil
 	}
-	if t2.SSH != nil { // merge
-		t.SSH = append(t.SSH, t2.SSH...)
+	if !filepath.IsAbs(dockerfilePath) {
+		dockerfilePath = filepath.Join(contextPath, dockerfilePath)
 	}
-	if t2.Platforms != nil { // no merge
-		t.Platforms = t2.Platforms
+	dockerfilePath, err := filepath.Abs(dockerfilePath)
+	if err != nil {
+		return "", "", false, err
 	}
-	if t2.CacheFrom != nil { // merge
-		t.CacheFrom = append(t.CacheFrom, t2.CacheFrom...)
+	return dockerfilePath, contextPath, true, nil
+}
+
+// Warning is a problem found in the definition of targets that does not
+// prevent building them.
+type Warning struct {
+	// Tag is the image tag the warning is about, if any.
+	Tag string
+	// Targets are the names of the targets involved, sorted.
+	Targets []string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("tag %s is set by multiple targets and may be overwritten: %s", w.Tag, strings.Join(w.Targets, ", "))
+}
+
+// ValidateConfig returns a warning for each image tag set by more than one
+// target of cfg, once the targets are resolved. Targets that are only
+// inherited by other targets, and not part of any group, are not built on
+// their own and are skipped. An error is returned if a target fails to
+// resolve.
+func ValidateConfig(cfg *Config) ([]Warning, error) {
+	inherited := map[string]struct{}{}
+	for _, t := range cfg.Targets {
+		for _, p := range t.Inherits {
+			inherited[p] = struct{}{}
+		}
 	}
-	if t2.CacheTo != nil { // no merge
-		t.CacheTo = t2.CacheTo
+	for _, g := range cfg.Groups {
+		for _, name := range cfg.ResolveGroup(g.Name) {
+			delete(inherited, name)
+		}
 	}
-	if t2.Outputs != nil { // no merge
-		t.Outputs = t2.Outputs
+
+	m := make(map[string]*Target, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		if _, ok := inherited[t.Name]; ok {
+			continue
+		}
+		rt, err := cfg.ResolveTarget(t.Name, nil)
+		if err != nil {
+			return nil, err
+		}
+		m[t.Name] = rt
 	}
-	if t2.Pull != nil {
-		t.Pull = t2.Pull
+	return tagCollisions(m), nil
+}
+
+// TagCollisionWarnings returns a warning for each image tag set by more than
+// one target, as the targets would overwrite each other's image. Tags are
+// compared once normalized, so alpine and docker.io/library/alpine:latest
+// collide. If strict is set, an error is returned for the first collision
+// instead.
+func TagCollisionWarnings(m map[string]*Target, strict bool) ([]string, error) {
+	var warnings []string
+	for _, w := range tagCollisions(m) {
+		if strict {
+			return nil, errors.Errorf("tag %s is set by multiple targets: %s", w.Tag, strings.Join(w.Targets, ", "))
+		}
+		warnings = append(warnings, w.String())
 	}
-	if t2.NoCache != nil {
-		t.NoCache = t2.NoCache
+	return warnings, nil
+}
+
+// SSHAgentWarnings returns a warning for each target requesting the default
+// SSH agent socket, with an ssh entry set to default without paths, while
+// SSH_AUTH_SOCK is not set, as the build would fail to forward the agent.
+func SSHAgentWarnings(m map[string]*Target) []string {
+	if runtime.GOOS == "windows" || os.Getenv("SSH_AUTH_SOCK") != "" {
+		return nil
 	}
-	if t2.NetworkMode != nil {
-		t.NetworkMode = t2.NetworkMode
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
 	}
-	if t2.NoCacheFilter != nil { // merge
-		t.NoCacheFilter = append(t.NoCacheFilter, t2.NoCacheFilter...)
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		for _, v := range m[name].SSH {
+			if strings.TrimSpace(v) == "default" {
+				warnings = append(warnings, fmt.Sprintf("target %s: ssh default is requested but SSH_AUTH_SOCK is not set, no agent socket will be forwarded", name))
+				break
+			}
+		}
 	}
-	t.Inherits = append(t.Inherits, t2.Inherits...)
+	return warnings
 }
 
-func (t *Target) AddOverrides(overrides map[string]Override) error {
-	for key, o := range overrides {
-		value := o.Value
-		keys := strings.SplitN(key, ".", 2)
-		switch keys[0] {
-		case "context":
-			t.Context = &value
-		case "dockerfile":
-			t.Dockerfile = &value
-		case "args":
-			if len(keys) != 2 {
-				return errors.Errorf("args require name")
-			}
-			if t.Args == nil {
-				t.Args = map[string]string{}
-			}
-			t.Args[keys[1]] = value
-		case "contexts":
-			if len(keys) != 2 {
-				return errors.Errorf("contexts require name")
+// tagCollisions returns the normalized tags set by multiple targets of m, in
+// the order they are first found in the targets sorted by name.
+func tagCollisions(m map[string]*Target) []Warning {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tags := map[string][]string{}
+	var order []string
+	for _, name := range names {
+		seen := map[string]struct{}{}
+		for _, tag := range m[name].Tags {
+			key := tag
+			if named, err := reference.ParseNormalizedNamed(tag); err == nil {
+				key = reference.TagNameOnly(named).String()
 			}
-			if t.Contexts == nil {
-				t.Contexts = map[string]string{}
+			if _, ok := seen[key]; ok {
+				continue
 			}
-			t.Contexts[keys[1]] = value
-		case "labels":
-			if len(keys) != 2 {
-				return errors.Errorf("labels require name")
+			seen[key] = struct{}{}
+			if _, ok := tags[key]; !ok {
+				order = append(order, key)
 			}
-			if t.Labels == nil {
-				t.Labels = map[string]string{}
+			tags[key] = append(tags[key], name)
+		}
+	}
+
+	var warnings []Warning
+	for _, tag := range order {
+		if len(tags[tag]) > 1 {
+			warnings = append(warnings, Warning{Tag: tag, Targets: tags[tag]})
+		}
+	}
+	return warnings
+}
+
+// ValidateContextsRoot checks that the local build contexts and named
+// contexts of the targets do not resolve outside of root.
+func ValidateContextsRoot(m map[string]*Target, root string) error {
+	root, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+	for name, t := range m {
+		contexts := []string{"."}
+		if t.Context != nil {
+			contexts[0] = *t.Context
+		}
+		for _, v := range t.Contexts {
+			contexts = append(contexts, v)
+		}
+		for _, v := range contexts {
+			v = strings.TrimPrefix(v, "cwd://")
+			if v == "-" || IsRemoteURL(v) || strings.HasPrefix(v, "target:") || strings.HasPrefix(v, "docker-image:") {
+				continue
 			}
-			t.Labels[keys[1]] = value
-		case "tags":
-			t.Tags = o.ArrValue
-		case "cache-from":
-			t.CacheFrom = o.ArrValue
-		case "cache-to":
-			t.CacheTo = o.ArrValue
-		case "target":
-			t.Target = &value
-		case "secrets":
-			t.Secrets = o.ArrValue
-		case "ssh":
-			t.SSH = o.ArrValue
-		case "platform":
-			t.Platforms = o.ArrValue
-		case "output":
-			t.Outputs = o.ArrValue
-		case "no-cache":
-			noCache, err := strconv.ParseBool(value)
+			p, err := resolvePath(v)
 			if err != nil {
-				return errors.Errorf("invalid value %s for boolean key no-cache", value)
+				return err
 			}
-			t.NoCache = &noCache
-		case "no-cache-filter":
-			t.NoCacheFilter = o.ArrValue
-		case "pull":
-			pull, err := strconv.ParseBool(value)
+			rel, err := filepath.Rel(root, p)
 			if err != nil {
-				return errors.Errorf("invalid value %s for boolean key pull", value)
+				return err
 			}
-			t.Pull = &pull
-		case "push":
-			_, err := strconv.ParseBool(value)
-			if err != nil {
-				return errors.Errorf("invalid value %s for boolean key push", value)
+			if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+				return errors.Errorf("target %s: context %s is outside of %s", name, v, root)
 			}
-			if len(t.Outputs) == 0 {
-				t.Outputs = append(t.Outputs, "type=image,push=true")
-			} else {
-				for i, output := range t.Outputs {
-					if typ := parseOutputType(output); typ == "image" || typ == "registry" {
-						t.Outputs[i] = t.Outputs[i] + ",push=" + value
-					}
-				}
+		}
+	}
+	return nil
+}
+
+// ValidateEntitlements checks that the entitlements requested by the targets
+// are listed in allowed, as granted on the command line, so a definition can
+// not grant itself privileged build features.
+func ValidateEntitlements(m map[string]*Target, allowed []string) error {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	allow := map[string]struct{}{}
+	for _, e := range allowed {
+		allow[e] = struct{}{}
+	}
+	for _, name := range names {
+		for _, e := range m[name].Entitlements {
+			if _, ok := allow[e]; !ok {
+				return errors.Errorf("target %s: entitlement %s is not allowed, grant it with --allow %s", name, e, e)
 			}
-		default:
-			return errors.Errorf("unknown key: %s", keys[0])
 		}
 	}
 	return nil
 }
 
+// parseUlimit parses a ulimit in the name=soft[:hard] format. Unlike
+// units.ParseUlimit, names unknown to the client are passed through unchanged
+// for the builder to validate.
+func parseUlimit(v string) (*units.Ulimit, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, errors.Errorf("invalid ulimit argument: %s", v)
+	}
+	limits := strings.Split(parts[1], ":")
+	if len(limits) > 2 {
+		return nil, errors.Errorf("too many limit value arguments - %s, can only have up to two, `soft[:hard]`", parts[1])
+	}
+	soft, err := strconv.ParseInt(limits[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if soft > hard {
+		return nil, errors.Errorf("ulimit soft limit must be less than or equal to hard limit: %d > %d", soft, hard)
+	}
+	return &units.Ulimit{Name: parts[0], Soft: soft, Hard: hard}, nil
+}
+
+// resolvePath returns the absolute path of p with symlinks evaluated if it
+// exists.
+func resolvePath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if rp, err := filepath.EvalSymlinks(p); err == nil {
+		return rp, nil
+	}
+	return p, nil
+}
+
 func TargetsToBuildOpt(m map[string]*Target, inp *Input) (map[string]build.Options, error) {
 	m2 := make(map[string]build.Options, len(m))
 	for k, v := range m {
@@ -823,6 +2445,8 @@ func toBuildOpt(t *Target, inp *Input) (*build.Options, error) {
 		dockerfilePath = *t.Dockerfile
 	}
 
+	// a relative dockerfile of a remote context is resolved within the fetched
+	// context at build time and must not be looked up locally
 	if !isRemoteResource(contextPath) && !path.IsAbs(dockerfilePath) {
 		dockerfilePath = path.Join(contextPath, dockerfilePath)
 	}
@@ -873,9 +2497,49 @@ func toBuildOpt(t *Target, inp *Input) (*build.Options, error) {
 		NoCacheFilter: t.NoCacheFilter,
 		Pull:          pull,
 		NetworkMode:   networkMode,
+		ExtraHosts:    t.ExtraHosts,
 		Linked:        t.linked,
 	}
 
+	if t.ShmSize != nil {
+		if err := bo.ShmSize.Set(*t.ShmSize); err != nil {
+			return nil, errors.Wrapf(err, "invalid shm-size %s", *t.ShmSize)
+		}
+	}
+
+	allow, err := buildflags.ParseEntitlements(t.Entitlements)
+	if err != nil {
+		return nil, err
+	}
+	bo.Allow = allow
+
+	if bo.CallFunc, err = t.callFunc(); err != nil {
+		return nil, err
+	}
+
+	if len(t.Ulimits) > 0 {
+		ulimits := map[string]*units.Ulimit{}
+		for _, v := range t.Ulimits {
+			u, err := parseUlimit(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid ulimit %s", v)
+			}
+			ulimits[u.Name] = u
+		}
+		bo.Ulimits = opts.NewUlimitOpt(&ulimits)
+	}
+
+	annotations, err := parseAnnotations(t.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range annotations {
+		if bo.Annotations == nil {
+			bo.Annotations = map[string]string{}
+		}
+		bo.Annotations[annotationExportAttr(k)] = v
+	}
+
 	platforms, err := platformutil.Parse(t.Platforms)
 	if err != nil {
 		return nil, err
@@ -904,13 +2568,18 @@ func toBuildOpt(t *Target, inp *Input) (*build.Options, error) {
 		bo.Target = *t.Target
 	}
 
-	cacheImports, err := buildflags.ParseCacheEntry(t.CacheFrom)
+	cacheImports, err := parseCacheEntries(t.CacheFrom)
 	if err != nil {
 		return nil, err
 	}
+	for _, ci := range cacheImports {
+		if _, ok := cacheImportTypes[ci.Type]; !ok {
+			return nil, errors.Errorf("unknown cache-from type %q", ci.Type)
+		}
+	}
 	bo.CacheFrom = cacheImports
 
-	cacheExports, err := buildflags.ParseCacheEntry(t.CacheTo)
+	cacheExports, err := parseCacheEntries(t.CacheTo)
 	if err != nil {
 		return nil, err
 	}
@@ -925,6 +2594,68 @@ func toBuildOpt(t *Target, inp *Input) (*build.Options, error) {
 	return bo, nil
 }
 
+// parseCacheEntries parses cache entries, expanding the s3:// shorthands, and
+// checks that s3 entries set the attributes required by the backend.
+func parseCacheEntries(in []string) ([]client.CacheOptionsEntry, error) {
+	in, err := expandCacheShorthand(in)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := buildflags.ParseCacheEntry(in)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type != "s3" {
+			continue
+		}
+		for _, k := range []string{"bucket", "region"} {
+			if e.Attrs[k] == "" {
+				return nil, errors.Errorf("s3 cache requires %s attribute", k)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// expandCacheShorthand rewrites s3://bucket/prefix?region=... cache entries
+// to the type=s3,bucket=bucket,prefix=prefix/,region=... format. The query
+// parameters are set as attributes of the entry.
+func expandCacheShorthand(in []string) ([]string, error) {
+	if len(in) == 0 {
+		return in, nil
+	}
+	res := make([]string, 0, len(in))
+	for _, v := range in {
+		if !strings.HasPrefix(v, "s3://") {
+			res = append(res, v)
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid s3 cache %s", v)
+		}
+		if u.Host == "" {
+			return nil, errors.Errorf("invalid s3 cache %s: bucket required", v)
+		}
+		attrs := []string{"type=s3", "bucket=" + u.Host}
+		if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+			attrs = append(attrs, "prefix="+prefix+"/")
+		}
+		q := u.Query()
+		keys := make([]string, 0, len(q))
+		for k := range q {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			attrs = append(attrs, k+"="+q.Get(k))
+		}
+		res = append(res, strings.Join(attrs, ","))
+	}
+	return res, nil
+}
+
 func defaultTarget() *Target {
 	return &Target{}
 }
@@ -946,25 +2677,113 @@ func removeDupes(s []string) []string {
 	return s[:i]
 }
 
+// dedupePlatforms normalizes the platforms of s to their canonical spelling,
+// like linux/arm64 for linux/arm64/v8 or linux/amd64 for linux/x86_64, and
+// removes the platforms that are equal once normalized. Default variants are
+// not added, so linux/arm is kept as is. Os-only platforms, the local platform
+// and platforms that cannot be parsed are kept as is.
+func dedupePlatforms(s []string) []string {
+	if len(s) == 0 {
+		return s
+	}
+	res := make([]string, 0, len(s))
+	seen := make(map[string]struct{}, len(s))
+	for _, v := range s {
+		key := v
+		if strings.Contains(v, "/") {
+			if p, err := platforms.Parse(v); err == nil {
+				n := platforms.Normalize(p)
+				key = platforms.Format(n)
+				if p.Variant == "" {
+					n.Variant = ""
+				}
+				v = platforms.Format(n)
+			}
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		res = append(res, v)
+	}
+	return res
+}
+
+// splitPlatforms splits comma-separated platforms entries so each element of
+// the returned slice holds a single platform.
+func splitPlatforms(s []string) []string {
+	var res []string
+	for _, v := range s {
+		for _, p := range strings.Split(v, ",") {
+			res = append(res, strings.TrimSpace(p))
+		}
+	}
+	return res
+}
+
 func isRemoteResource(str string) bool {
-	return urlutil.IsGitURL(str) || urlutil.IsURL(str)
+	return urlutil.IsGitURL(str) || urlutil.IsURL(str) || strings.HasPrefix(str, "ssh://")
 }
 
 func parseOutputType(str string) string {
+	typ, _ := parseOutputAttr(str, "type")
+	return typ
+}
+
+func parseOutputAttr(str, key string) (string, bool) {
 	csvReader := csv.NewReader(strings.NewReader(str))
 	fields, err := csvReader.Read()
 	if err != nil {
-		return ""
+		return "", false
 	}
 	for _, field := range fields {
 		parts := strings.SplitN(field, "=", 2)
 		if len(parts) == 2 {
-			if parts[0] == "type" {
-				return parts[1]
+			if parts[0] == key {
+				return parts[1], true
 			}
 		}
 	}
-	return ""
+	return "", false
+}
+
+// parseAnnotations parses annotations in the key=value format. Keys follow
+// the OCI recommendation of reverse domain notation, like
+// org.opencontainers.image.title, and can be prefixed by the type of object
+// to annotate, optionally for a single platform, like
+// index:org.opencontainers.image.title or manifest[linux/amd64]:com.example.id.
+func parseAnnotations(in []string) (map[string]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(in))
+	for _, v := range in {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid annotation %q, expected key=value", v)
+		}
+		key := parts[0]
+		if m := annotationTypePattern.FindStringSubmatch(key); m != nil {
+			key = m[3]
+		}
+		if !annotationKeyPattern.MatchString(key) {
+			return nil, errors.Errorf("invalid annotation key %q", parts[0])
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
+
+// annotationExportAttr returns the image exporter attribute setting the
+// annotation key, like annotation-index.org.opencontainers.image.title for
+// index:org.opencontainers.image.title. Keys without a type annotate the
+// image manifests.
+func annotationExportAttr(key string) string {
+	m := annotationTypePattern.FindStringSubmatch(key)
+	if m == nil {
+		return "annotation." + key
+	}
+	return "annotation-" + m[1] + m[2] + "." + m[3]
 }
 
 func validateTargetName(name string) error {
@@ -974,6 +2793,41 @@ func validateTargetName(name string) error {
 	return nil
 }
 
+func copySlice(s []string) []string {
+	return append([]string{}, s...)
+}
+
+func copyMap(m map[string]string) map[string]string {
+	m2 := make(map[string]string, len(m))
+	for k, v := range m {
+		m2[k] = v
+	}
+	return m2
+}
+
+// stringsEqual reports whether both slices hold the same values in the same
+// order.
+func stringsEqual(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sliceContains(s []string, v string) bool {
+	for _, vv := range s {
+		if vv == v {
+			return true
+		}
+	}
+	return false
+}
+
 func sliceEqual(s1, s2 []string) bool {
 	if len(s1) != len(s2) {
 		return false
@@ -1,9 +1,15 @@
 package bake
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -297,6 +303,33 @@ services:
 	require.Equal(t, []string{"db", "newservice", "webapp"}, g[0].Targets)
 }
 
+func TestParseFilesComposeGroupsNotDuplicated(t *testing.T) {
+	t.Parallel()
+
+	fp := File{
+		Name: "docker-compose.yml",
+		Data: []byte(
+			`services:
+  db:
+    build: .
+`),
+	}
+	fp2 := File{
+		Name: "docker-compose2.yml",
+		Data: []byte(
+			`services:
+  webapp:
+    build: .
+`),
+	}
+
+	c, err := ParseFiles([]File{fp, fp2}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Groups))
+	require.Equal(t, "default", c.Groups[0].Name)
+	require.Equal(t, []string{"db", "webapp"}, c.Groups[0].Targets)
+}
+
 func TestHCLCwdPrefix(t *testing.T) {
 	fp := File{
 		Name: "docker-bake.hcl",
@@ -353,6 +386,42 @@ func TestOverrideMerge(t *testing.T) {
 	require.Equal(t, "type=registry", m["app"].Outputs[0])
 }
 
+func TestOverrideArgsFile(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(
+			`target "app" {
+				args = {
+					FOO = "foo"
+					BAR = "bar"
+				}
+			}`),
+	}
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "extra.env")
+	err := os.WriteFile(envFile, []byte("BAR=file\nBAZ=file\nQUX=file\n"), 0644)
+	require.NoError(t, err)
+
+	ctx := context.TODO()
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app"}, []string{
+		"app.args.@=" + envFile,
+		"app.args.QUX=override",
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"FOO": "foo",
+		"BAR": "file",
+		"BAZ": "file",
+		"QUX": "override",
+	}, m["app"].Args)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"app"}, []string{
+		"app.args.@=" + filepath.Join(dir, "missing.env"),
+	}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read args file")
+}
+
 func TestReadContexts(t *testing.T) {
 	fp := File{
 		Name: "docker-bake.hcl",
@@ -1121,3 +1190,1542 @@ target "f" {
 		})
 	}
 }
+
+func TestConfigPrune(t *testing.T) {
+	c, err := ParseFile([]byte(`
+group "default" {
+  targets = ["app", "base", "image"]
+}
+
+target "base" {
+  dockerfile = "base.Dockerfile"
+}
+
+target "app" {
+  inherits = ["base"]
+}
+
+target "image" {
+  tags = ["foo"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"image"}, c.Prune())
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, "base", c.Targets[0].Name)
+	require.Equal(t, "app", c.Targets[1].Name)
+	require.Equal(t, []string{"app", "base"}, c.Groups[0].Targets)
+
+	require.Nil(t, c.Prune())
+
+	c, err = ParseFile([]byte(`
+group "default" {
+  targets = ["app", "meta-image"]
+}
+
+target "base" {
+  args = {
+    FOO = "bar"
+  }
+}
+
+target "app" {
+  inherits = ["base"]
+  context = "."
+}
+
+target "meta" {
+  tags = ["foo"]
+}
+
+target "meta-image" {
+  inherits = ["meta"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"meta", "meta-image"}, c.Prune())
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, "base", c.Targets[0].Name)
+	require.Equal(t, "app", c.Targets[1].Name)
+	require.Equal(t, []string{"app"}, c.Groups[0].Targets)
+
+	rt, err := ResolveTarget(c, "app", nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"FOO": "bar"}, rt.Args)
+}
+
+func TestConfigPlatforms(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "base" {
+  platforms = ["linux/arm64", "linux/amd64"]
+}
+
+target "app" {
+  inherits = ["base"]
+}
+
+target "arm" {
+  platforms = ["linux/arm/v7,linux/arm64"]
+}
+
+target "host" {
+  dockerfile = "host.Dockerfile"
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"linux/amd64", "linux/arm/v7", "linux/arm64"}, c.Platforms())
+	require.Equal(t, []string{"linux/amd64", "linux/arm/v7", "linux/arm64", "linux/riscv64"}, c.PlatformsWithDefault("linux/riscv64"))
+}
+
+func TestConfigRetagWithRegistry(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "app" {
+  tags = ["user/app:1.0", "alpine", "ghcr.io/org/team/app:latest"]
+}
+
+target "digest" {
+  tags = ["user/db@sha256:2b2d2ceb2d9b81b7b80d0bbd8c4b0d4b8f0c5d0bfe6c8d0f1b2c3d4e5f6a7b8c"]
+}
+
+target "notags" {
+  dockerfile = "notags.Dockerfile"
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	err = c.RetagWithRegistry("staging.example.com:5000/promo/", false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target digest: cannot retag digest reference")
+
+	require.NoError(t, c.RetagWithRegistry("staging.example.com:5000/promo/", true))
+	require.Equal(t, []string{
+		"staging.example.com:5000/promo/user/app:1.0",
+		"staging.example.com:5000/promo/alpine",
+		"staging.example.com:5000/promo/org/team/app:latest",
+	}, c.Targets[0].Tags)
+	require.Equal(t, []string{"user/db@sha256:2b2d2ceb2d9b81b7b80d0bbd8c4b0d4b8f0c5d0bfe6c8d0f1b2c3d4e5f6a7b8c"}, c.Targets[1].Tags)
+	require.Nil(t, c.Targets[2].Tags)
+}
+
+func TestConfigQualifyTags(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "app" {
+  tags = ["app:1", "user/app:1.0", "ghcr.io/org/app:latest", "localhost/app", "localhost:5000/app:dev", "docker.io/user/app"]
+}
+
+target "notags" {
+  dockerfile = "notags.Dockerfile"
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.NoError(t, c.QualifyTags("registry.example.com/"))
+	require.Equal(t, []string{
+		"registry.example.com/app:1",
+		"registry.example.com/user/app:1.0",
+		"ghcr.io/org/app:latest",
+		"localhost/app",
+		"localhost:5000/app:dev",
+		"docker.io/user/app",
+	}, c.Targets[0].Tags)
+	require.Nil(t, c.Targets[1].Tags)
+
+	c, err = ParseFile([]byte(`
+target "app" {
+  tags = ["app:1", "User/App"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+	err = c.QualifyTags("registry.example.com")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target app: invalid tag User/App")
+	require.Equal(t, []string{"app:1", "User/App"}, c.Targets[0].Tags)
+
+	err = c.QualifyTags("Registry.example.com:port")
+	require.Error(t, err)
+	require.Equal(t, []string{"app:1", "User/App"}, c.Targets[0].Tags)
+}
+
+func TestTargetWillPush(t *testing.T) {
+	cases := []struct {
+		outputs []string
+		push    bool
+	}{
+		{outputs: nil, push: false},
+		{outputs: []string{"type=docker"}, push: false},
+		{outputs: []string{"type=image"}, push: false},
+		{outputs: []string{"type=image,push=false"}, push: false},
+		{outputs: []string{"type=local,dest=out"}, push: false},
+		{outputs: []string{"type=registry"}, push: true},
+		{outputs: []string{"type=image,push=true"}, push: true},
+		{outputs: []string{"type=image,name=foo,push=1"}, push: true},
+		{outputs: []string{"type=docker", "type=image,push=true"}, push: true},
+		{outputs: []string{"push=true"}, push: true},
+	}
+	for _, tt := range cases {
+		tt := tt
+		t.Run(strings.Join(tt.outputs, ";"), func(t *testing.T) {
+			tgt := &Target{Outputs: tt.outputs}
+			require.Equal(t, tt.push, tgt.WillPush())
+		})
+	}
+}
+
+func TestReadTargetsPlatformsOutputs(t *testing.T) {
+	ctx := context.TODO()
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "docker" {
+  platforms = ["linux/amd64", "linux/arm64"]
+  output = ["type=docker"]
+}
+
+target "registry" {
+  platforms = ["linux/amd64", "linux/arm64"]
+  output = ["type=registry"]
+}
+
+target "single" {
+  platforms = ["linux/amd64"]
+  output = ["type=docker"]
+}`),
+	}
+
+	_, _, err := ReadTargets(ctx, []File{fp}, []string{"docker"}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target docker: docker exporter does not support multiple platforms")
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"registry", "single"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(m))
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"registry"}, []string{"registry.output=type=docker"}, nil)
+	require.Error(t, err)
+}
+
+func TestMaskArgs(t *testing.T) {
+	m := map[string]*Target{
+		"app": {
+			Name: "app",
+			Args: map[string]string{
+				"GITHUB_TOKEN": "ghp_secret",
+				"db_password":  "hunter2",
+				"VERSION":      "1.0",
+			},
+		},
+	}
+
+	masked := MaskArgs(m, SensitiveArgsPattern)
+	require.Equal(t, map[string]string{
+		"GITHUB_TOKEN": "*****",
+		"db_password":  "*****",
+		"VERSION":      "1.0",
+	}, masked["app"].Args)
+	require.Equal(t, "ghp_secret", m["app"].Args["GITHUB_TOKEN"])
+
+	masked = MaskArgs(m, regexp.MustCompile(`^VERSION$`))
+	require.Equal(t, "ghp_secret", masked["app"].Args["GITHUB_TOKEN"])
+	require.Equal(t, "*****", masked["app"].Args["VERSION"])
+}
+
+func TestReadTargetsPlatformsCommaSeparated(t *testing.T) {
+	ctx := context.TODO()
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "app" {
+  platforms = ["linux/amd64,linux/arm64", "linux/arm64"]
+}`),
+	}
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64"}, m["app"].Platforms)
+
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"app"}, []string{"app.platform=linux/arm/v7,linux/s390x"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/arm/v7", "linux/s390x"}, m["app"].Platforms)
+}
+
+func TestConfigApplyDefaults(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "app" {
+  platforms = ["linux/arm64"]
+}
+
+target "db" {
+  dockerfile = "db.Dockerfile"
+  cache-from = ["type=local,src=db-cache"]
+  no-cache = false
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	c.ApplyDefaults(&Target{
+		Platforms: []string{"linux/amd64"},
+		CacheFrom: []string{"type=gha"},
+		NoCache:   newBool(true),
+	})
+
+	require.Equal(t, "app", c.Targets[0].Name)
+	require.Equal(t, []string{"linux/arm64"}, c.Targets[0].Platforms)
+	require.Equal(t, []string{"type=gha"}, c.Targets[0].CacheFrom)
+	require.Equal(t, newBool(true), c.Targets[0].NoCache)
+	require.Nil(t, c.Targets[0].Dockerfile)
+
+	require.Equal(t, "db", c.Targets[1].Name)
+	require.Equal(t, []string{"linux/amd64"}, c.Targets[1].Platforms)
+	require.Equal(t, []string{"type=local,src=db-cache"}, c.Targets[1].CacheFrom)
+	require.Equal(t, newBool(false), c.Targets[1].NoCache)
+	require.Equal(t, "db.Dockerfile", *c.Targets[1].Dockerfile)
+}
+
+func TestValidateDockerfiles(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch"), 0644)
+	require.NoError(t, err)
+
+	m := map[string]*Target{
+		"app": {
+			Context: &dir,
+		},
+		"remote": {
+			Context:    stringPtr("https://github.com/docker/buildx.git"),
+			Dockerfile: stringPtr("missing.Dockerfile"),
+		},
+		"inline": {
+			Context:          &dir,
+			Dockerfile:       stringPtr("missing.Dockerfile"),
+			DockerfileInline: stringPtr("FROM scratch"),
+		},
+	}
+	require.NoError(t, ValidateDockerfiles(m))
+
+	m["missing"] = &Target{
+		Context:    &dir,
+		Dockerfile: stringPtr("missing.Dockerfile"),
+	}
+	err = ValidateDockerfiles(m)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target missing: dockerfile not found at "+filepath.Join(dir, "missing.Dockerfile"))
+	require.Contains(t, err.Error(), "context "+dir)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestCacheFromOrder(t *testing.T) {
+	ctx := context.TODO()
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+  cache-from = ["type=registry,ref=user/app:main", "type=local,src=cache"]
+}
+
+target "app" {
+  inherits = ["base"]
+  cache-from = ["type=local,src=app-cache", "type=registry,ref=user/app:main", "user/app:pr"]
+}`),
+	}
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"type=registry,ref=user/app:main",
+		"type=local,src=cache",
+		"type=local,src=app-cache",
+		"user/app:pr",
+	}, m["app"].CacheFrom)
+
+	bo, err := TargetsToBuildOpt(m, nil)
+	require.NoError(t, err)
+	var types []string
+	for _, ci := range bo["app"].CacheFrom {
+		types = append(types, ci.Type)
+	}
+	var srcs []string
+	for _, ci := range bo["app"].CacheFrom {
+		srcs = append(srcs, ci.Attrs["ref"]+ci.Attrs["src"])
+	}
+	require.Equal(t, []string{"registry", "local", "local", "registry"}, types)
+	require.Equal(t, []string{"user/app:main", "cache", "app-cache", "user/app:pr"}, srcs)
+
+	m["app"].CacheFrom = []string{"type=unknown,ref=foo"}
+	_, err = TargetsToBuildOpt(m, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown cache-from type "unknown"`)
+}
+
+func TestMergePolicy(t *testing.T) {
+	newTargets := func() (*Target, *Target) {
+		return &Target{
+			Name:       "app",
+			Dockerfile: stringPtr("Dockerfile"),
+			Tags:       []string{"app:v1"},
+		}, &Target{
+			Name:       "app",
+			Dockerfile: stringPtr("Dockerfile.rel"),
+			Tags:       []string{"app:latest"},
+		}
+	}
+
+	t.Run("LastWins", func(t *testing.T) {
+		t1, t2 := newTargets()
+		require.NoError(t, t1.MergeWithPolicy(t2, MergeLastWins))
+		require.Equal(t, "Dockerfile.rel", *t1.Dockerfile)
+		require.Equal(t, []string{"app:latest"}, t1.Tags)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		t1, t2 := newTargets()
+		err := t1.MergeWithPolicy(t2, MergeError)
+		require.Error(t, err)
+		require.Equal(t, `conflicting values for dockerfile in target app: "Dockerfile" and "Dockerfile.rel"`, err.Error())
+
+		t1, t2 = newTargets()
+		t2.Dockerfile = nil
+		err = t1.MergeWithPolicy(t2, MergeError)
+		require.Error(t, err)
+		require.Equal(t, `conflicting values for tags in target app: [app:v1] and [app:latest]`, err.Error())
+
+		t1, t2 = newTargets()
+		t2.Dockerfile = t1.Dockerfile
+		t2.Tags = []string{"app:v1"}
+		t2.Platforms = []string{"linux/amd64"}
+		t1.Description = stringPtr("app")
+		t2.Description = stringPtr("the app")
+		require.NoError(t, t1.MergeWithPolicy(t2, MergeError))
+		require.Equal(t, []string{"linux/amd64"}, t1.Platforms)
+		require.Equal(t, "the app", *t1.Description)
+	})
+
+	t.Run("Deep", func(t *testing.T) {
+		t1, t2 := newTargets()
+		require.NoError(t, t1.MergeWithPolicy(t2, MergeDeep))
+		require.Equal(t, "Dockerfile.rel", *t1.Dockerfile)
+		require.Equal(t, []string{"app:v1", "app:latest"}, t1.Tags)
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		t1, t2 := newTargets()
+		_, err := mergeConfig(Config{Targets: []*Target{t1}}, Config{Targets: []*Target{t2}}, MergeError)
+		require.Error(t, err)
+
+		t1, t2 = newTargets()
+		c, err := mergeConfig(Config{Targets: []*Target{t1}}, Config{Targets: []*Target{t2}}, MergeDeep)
+		require.NoError(t, err)
+		c, err = dedupeConfig(c, MergeDeep)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(c.Targets))
+		require.Equal(t, []string{"app:v1", "app:latest"}, c.Targets[0].Tags)
+	})
+}
+
+func TestParseAnnotations(t *testing.T) {
+	cases := []struct {
+		annotation string
+		wantErr    string
+	}{
+		{
+			annotation: "org.opencontainers.image.title=webapp",
+		},
+		{
+			annotation: "com.example/build-id=",
+		},
+		{
+			annotation: "=webapp",
+			wantErr:    `invalid annotation key ""`,
+		},
+		{
+			annotation: "org.opencontainers image.title=webapp",
+			wantErr:    `invalid annotation key "org.opencontainers image.title"`,
+		},
+		{
+			annotation: "org.opencontainers.image.title",
+			wantErr:    `invalid annotation "org.opencontainers.image.title", expected key=value`,
+		},
+		{
+			annotation: "index:org.opencontainers.image.title=webapp",
+		},
+		{
+			annotation: "manifest-descriptor[linux/amd64]:org.opencontainers.image.title=webapp",
+		},
+		{
+			annotation: "layer:org.opencontainers.image.title=webapp",
+			wantErr:    `invalid annotation key "layer:org.opencontainers.image.title"`,
+		},
+	}
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.annotation, func(t *testing.T) {
+			_, err := parseAnnotations([]string{tt.annotation})
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	m, err := parseAnnotations([]string{"org.opencontainers.image.title=webapp"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"org.opencontainers.image.title": "webapp"}, m)
+
+	require.Equal(t, "annotation.com.example.id", annotationExportAttr("com.example.id"))
+	require.Equal(t, "annotation-index.com.example.id", annotationExportAttr("index:com.example.id"))
+	require.Equal(t, "annotation-manifest[linux/arm64].com.example.id", annotationExportAttr("manifest[linux/arm64]:com.example.id"))
+
+	_, err = TargetsToBuildOpt(map[string]*Target{
+		"app": {Annotations: []string{"bad key=foo"}},
+	}, nil)
+	require.Error(t, err)
+}
+
+func TestTargetJSONFieldOrder(t *testing.T) {
+	dt, err := json.Marshal(&Target{
+		Name:        "app",
+		Platforms:   []string{"linux/amd64"},
+		Tags:        []string{"app:latest"},
+		Args:        map[string]string{"B": "2", "A": "1"},
+		Dockerfile:  stringPtr("Dockerfile"),
+		Context:     stringPtr("."),
+		Outputs:     []string{"type=docker"},
+		CacheFrom:   []string{"type=local,src=cache"},
+		NoCache:     newBool(true),
+		Annotations: []string{"org.opencontainers.image.title=app"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"context":".","dockerfile":"Dockerfile","args":{"A":"1","B":"2"},"annotations":["org.opencontainers.image.title=app"],"tags":["app:latest"],"cache-from":["type=local,src=cache"],"platforms":["linux/amd64"],"output":["type=docker"],"no-cache":true}`, string(dt))
+}
+
+func TestValidateContextsRoot(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "app"), 0755))
+
+	m := map[string]*Target{
+		"app": {
+			Context: stringPtr(filepath.Join(root, "app")),
+			Contexts: map[string]string{
+				"base":   "docker-image://alpine",
+				"shared": filepath.Join(root, "app", "..", "shared"),
+				"remote": "https://github.com/docker/buildx.git",
+			},
+		},
+	}
+	require.NoError(t, ValidateContextsRoot(m, root))
+
+	m["escape"] = &Target{
+		Context: stringPtr(filepath.Join(root, "app", "..", "..", "..", "etc")),
+	}
+	err := ValidateContextsRoot(m, root)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target escape: context")
+	require.Contains(t, err.Error(), "is outside of")
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	err = ValidateContextsRoot(map[string]*Target{
+		"app": {Context: stringPtr("../../etc")},
+	}, wd)
+	require.Error(t, err)
+	require.NoError(t, ValidateContextsRoot(map[string]*Target{
+		"app": {Context: stringPtr("./hclparser")},
+	}, wd))
+}
+
+func TestValidateEntitlements(t *testing.T) {
+	m := map[string]*Target{
+		"app": {},
+		"insecure": {
+			Entitlements: []string{"network.host", "security.insecure"},
+		},
+	}
+	require.NoError(t, ValidateEntitlements(m, []string{"network.host", "security.insecure"}))
+
+	err := ValidateEntitlements(m, []string{"network.host"})
+	require.Error(t, err)
+	require.Equal(t, "target insecure: entitlement security.insecure is not allowed, grant it with --allow security.insecure", err.Error())
+
+	require.Error(t, ValidateEntitlements(m, nil))
+	require.NoError(t, ValidateEntitlements(map[string]*Target{"app": {}}, nil))
+}
+
+func TestReadTargetsPush(t *testing.T) {
+	ctx := context.TODO()
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "default" {
+  push = true
+}
+
+target "image" {
+  push = true
+  output = ["type=image,name=user/app"]
+}
+
+target "docker" {
+  push = true
+  output = ["type=docker"]
+}`),
+	}
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"default", "image"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=image,push=true"}, m["default"].Outputs)
+	require.Equal(t, []string{"type=image,name=user/app,push=true"}, m["image"].Outputs)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"docker"}, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, "target docker: push conflicts with output type=docker", err.Error())
+
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"docker"}, []string{"docker.output=type=registry"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=registry"}, m["docker"].Outputs)
+
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"default", "image", "docker"}, []string{"*.push=false"}, nil)
+	require.NoError(t, err)
+	require.False(t, *m["default"].Push)
+	require.Nil(t, m["default"].Outputs)
+	require.Equal(t, []string{"type=image,name=user/app,push=false"}, m["image"].Outputs)
+	require.Equal(t, []string{"type=docker"}, m["docker"].Outputs)
+	for name, tgt := range m {
+		require.False(t, tgt.WillPush(), name)
+	}
+}
+
+func TestReadTargetsPushInherited(t *testing.T) {
+	ctx := context.TODO()
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+  output = ["type=image,name=foo/bar"]
+}
+
+target "pushed" {
+  inherits = ["base"]
+  push = true
+}
+
+target "local" {
+  inherits = ["base"]
+}`),
+	}
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"pushed", "local"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=image,name=foo/bar,push=true"}, m["pushed"].Outputs)
+	require.Equal(t, []string{"type=image,name=foo/bar"}, m["local"].Outputs)
+}
+
+func TestReadTargetsLoad(t *testing.T) {
+	ctx := context.TODO()
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "single" {
+  load = true
+  platforms = ["linux/amd64"]
+}
+
+target "multi" {
+  load = true
+  platforms = ["linux/amd64", "linux/arm64"]
+}
+
+target "both" {
+  load = true
+  push = true
+}`),
+	}
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"single"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=docker"}, m["single"].Outputs)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"multi"}, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, "target multi: load is not supported for multiple platforms [linux/amd64 linux/arm64]", err.Error())
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"single"}, []string{"single.output=type=local,dest=out"}, nil)
+	require.Error(t, err)
+	require.Equal(t, "target single: load conflicts with output type=local,dest=out", err.Error())
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"both"}, nil, nil)
+	require.Error(t, err)
+
+	// the overrides of the command line win over push and load of the file
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"both"}, []string{"*.output=type=docker", "*.load=true"}, nil)
+	require.NoError(t, err)
+	require.Nil(t, m["both"].Push)
+	require.Equal(t, []string{"type=docker"}, m["both"].Outputs)
+
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"single"}, []string{"*.push=true"}, nil)
+	require.NoError(t, err)
+	require.Nil(t, m["single"].Load)
+	require.Equal(t, []string{"type=image,push=true"}, m["single"].Outputs)
+
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"single"}, []string{"single.load=false"}, nil)
+	require.NoError(t, err)
+	require.Nil(t, m["single"].Outputs)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"multi"}, []string{"*.output=type=docker", "*.load=true"}, nil)
+	require.Error(t, err)
+	require.Equal(t, "target multi: load is not supported for multiple platforms [linux/amd64 linux/arm64]", err.Error())
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"single"}, []string{"single.load=maybe"}, nil)
+	require.Error(t, err)
+	require.Equal(t, "invalid value maybe for boolean key load", err.Error())
+}
+
+func TestRemoteContextRelativeDockerfile(t *testing.T) {
+	// run from an empty directory so any attempt to resolve the dockerfile
+	// locally would fail
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	contexts := map[string]string{
+		"https":  "https://github.com/docker/buildx.git",
+		"subdir": "https://github.com/docker/buildx.git#master:docs",
+		"github": "github.com/docker/buildx",
+	}
+	m := map[string]*Target{}
+	for name, c := range contexts {
+		m[name] = &Target{
+			Context:    stringPtr(c),
+			Dockerfile: stringPtr("build/app.Dockerfile"),
+		}
+	}
+	require.NoError(t, ValidateDockerfiles(m))
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	for name, c := range contexts {
+		require.Equal(t, c, bo[name].Inputs.ContextPath)
+		require.Equal(t, "build/app.Dockerfile", bo[name].Inputs.DockerfilePath)
+	}
+}
+
+func TestRemoteContextGitSSH(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	// ssh git contexts enable the default ssh agent forwarding
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	require.NoError(t, err)
+	defer l.Close()
+	t.Setenv("SSH_AUTH_SOCK", l.Addr().String())
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "app" {
+  context = "ssh://git@github.com/docker/buildx.git#master"
+  dockerfile = "build/app.Dockerfile"
+}`),
+	}
+	ctx := context.TODO()
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "ssh://git@github.com/docker/buildx.git#master", *m["app"].Context)
+	require.True(t, IsRemoteURL(*m["app"].Context))
+	require.NoError(t, ValidateDockerfiles(m))
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, "ssh://git@github.com/docker/buildx.git#master", bo["app"].Inputs.ContextPath)
+	require.Equal(t, "build/app.Dockerfile", bo["app"].Inputs.DockerfilePath)
+}
+
+func TestInlineDockerfileStage(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "ok" {
+  dockerfile-inline = <<EOT
+FROM alpine AS base
+FROM --platform=$BUILDPLATFORM base as Release
+EOT
+  target = "release"
+}
+
+target "missing" {
+  dockerfile-inline = "FROM alpine AS base\n"
+  target = "release"
+}`),
+	}
+	ctx := context.TODO()
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"ok"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "release", *m["ok"].Target)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"missing"}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `target missing: stage "release" not found in inline dockerfile`)
+}
+
+func TestApplyOutputOverride(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "default" {
+  dockerfile = "Dockerfile"
+  push = true
+}
+target "image" {
+  output = ["type=image,name=foo"]
+}
+target "registry" {
+  output = ["type=registry", "type=image,name=bar"]
+}
+target "local" {
+  output = ["type=local,dest=out"]
+}
+target "inherited" {
+  inherits = ["local"]
+}
+target "multi" {
+  platforms = ["linux/amd64", "linux/arm64"]
+}`),
+	}
+	ctx := context.TODO()
+	targets := []string{"default", "image", "registry", "local", "inherited"}
+
+	c, err := ParseFile(fp.Data, fp.Name)
+	require.NoError(t, err)
+	ApplyOutputOverride(c, "type=registry,name=ci")
+	for _, tgt := range c.Targets {
+		require.Equal(t, []string{"type=registry,name=ci"}, tgt.Outputs, tgt.Name)
+		require.Nil(t, tgt.Push, tgt.Name)
+	}
+
+	m, _, _, err := ReadTargetsWithOpt(ctx, []File{fp}, targets, nil, ReadOpt{Output: "type=registry,name=ci"})
+	require.NoError(t, err)
+	for _, name := range targets {
+		require.Equal(t, []string{"type=registry,name=ci"}, m[name].Outputs, name)
+	}
+
+	c, err = ParseFile(fp.Data, fp.Name)
+	require.NoError(t, err)
+	ApplyOutputOverridePreserving(c, "type=registry,name=ci")
+	outputs := map[string][]string{}
+	for _, tgt := range c.Targets {
+		outputs[tgt.Name] = tgt.Outputs
+	}
+	require.Equal(t, map[string][]string{
+		"default":   {"type=registry,name=ci"},
+		"image":     {"type=registry,name=ci"},
+		"registry":  {"type=registry,name=ci"},
+		"local":     {"type=local,dest=out"},
+		"inherited": {"type=local,dest=out"},
+		"multi":     {"type=registry,name=ci"},
+	}, outputs)
+
+	m, _, _, err = ReadTargetsWithOpt(ctx, []File{fp}, targets, nil, ReadOpt{Output: "type=registry,name=ci", PreserveOutputs: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=registry,name=ci"}, m["default"].Outputs)
+	require.Equal(t, []string{"type=local,dest=out"}, m["inherited"].Outputs)
+
+	// overrides take precedence over the output override
+	m, _, _, err = ReadTargetsWithOpt(ctx, []File{fp}, []string{"image"}, []string{"image.output=type=docker"}, ReadOpt{Output: "type=registry,name=ci"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=docker"}, m["image"].Outputs)
+
+	_, _, _, err = ReadTargetsWithOpt(ctx, []File{fp}, []string{"multi"}, nil, ReadOpt{Output: "type=docker"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target multi: docker exporter does not support multiple platforms")
+}
+
+func TestCacheS3Shorthand(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "app" {
+  cache-from = ["s3://mybucket/cache/app?region=us-east-1"]
+  cache-to = ["s3://mybucket?region=us-east-1&mode=max", "type=local,dest=out"]
+}`),
+	}
+	ctx := context.TODO()
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=s3,bucket=mybucket,prefix=cache/app/,region=us-east-1"}, m["app"].CacheFrom)
+	require.Equal(t, []string{"type=s3,bucket=mybucket,mode=max,region=us-east-1", "type=local,dest=out"}, m["app"].CacheTo)
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, "s3", bo["app"].CacheFrom[0].Type)
+	require.Equal(t, map[string]string{
+		"bucket": "mybucket",
+		"prefix": "cache/app/",
+		"region": "us-east-1",
+	}, bo["app"].CacheFrom[0].Attrs)
+
+	fp.Data = []byte(`
+target "app" {
+  cache-to = ["s3:///cache?region=us-east-1"]
+}`)
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.EqualError(t, err, "target app: invalid s3 cache s3:///cache?region=us-east-1: bucket required")
+
+	_, err = TargetsToBuildOpt(map[string]*Target{
+		"app": {CacheTo: []string{"type=s3,region=us-east-1"}},
+	}, &Input{})
+	require.EqualError(t, err, "s3 cache requires bucket attribute")
+
+	_, err = TargetsToBuildOpt(map[string]*Target{
+		"app": {CacheFrom: []string{"s3://mybucket"}},
+	}, &Input{})
+	require.EqualError(t, err, "s3 cache requires region attribute")
+}
+
+func TestKnownArgTypes(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "ok" {
+  args = {
+    BUILDKIT_INLINE_CACHE = "1"
+    SOURCE_DATE_EPOCH = "1660000000"
+    OTHER = "yes"
+  }
+}
+target "bool" {
+  args = {
+    BUILDKIT_INLINE_CACHE = "yes"
+  }
+}
+target "int" {
+  args = {
+    SOURCE_DATE_EPOCH = "today"
+  }
+}`),
+	}
+	ctx := context.TODO()
+	_, _, err := ReadTargets(ctx, []File{fp}, []string{"ok"}, nil, nil)
+	require.NoError(t, err)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"bool"}, nil, nil)
+	require.EqualError(t, err, `target bool: invalid value "yes" for build arg BUILDKIT_INLINE_CACHE, expected bool`)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"int"}, nil, nil)
+	require.EqualError(t, err, `target int: invalid value "today" for build arg SOURCE_DATE_EPOCH, expected int`)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"ok"}, []string{"ok.args.BUILDKIT_INLINE_CACHE=on"}, nil)
+	require.Error(t, err)
+}
+
+func TestTagCollisionWarnings(t *testing.T) {
+	m := map[string]*Target{
+		"app":    {Tags: []string{"docker.io/library/app:latest", "app:1.0"}},
+		"worker": {Tags: []string{"app", "worker:latest"}},
+		"api":    {Tags: []string{"api:latest", "api"}},
+		"other":  {Tags: []string{"app:1.0"}},
+	}
+	warnings, err := TagCollisionWarnings(m, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"tag docker.io/library/app:latest is set by multiple targets and may be overwritten: app, worker",
+		"tag docker.io/library/app:1.0 is set by multiple targets and may be overwritten: app, other",
+	}, warnings)
+
+	_, err = TagCollisionWarnings(m, true)
+	require.EqualError(t, err, "tag docker.io/library/app:latest is set by multiple targets: app, worker")
+
+	warnings, err = TagCollisionWarnings(map[string]*Target{
+		"api": {Tags: []string{"api:latest", "api"}},
+	}, true)
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+}
+
+func TestResolveTargetWithOverrides(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+  args = {
+    GO_VERSION = "1.17"
+    DEBUG = "0"
+  }
+  tags = ["base"]
+}
+target "app" {
+  inherits = ["base"]
+  args = {
+    DEBUG = "1"
+  }
+  tags = ["app:latest"]
+}`),
+	}
+	c, err := ParseFiles([]File{fp}, nil)
+	require.NoError(t, err)
+
+	tgt, err := ResolveTarget(c, "app", nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"GO_VERSION": "1.17", "DEBUG": "1"}, tgt.Args)
+	require.Equal(t, []string{"app:latest"}, tgt.Tags)
+
+	tgt, err = ResolveTarget(c, "app", map[string]string{
+		"app.args.GO_VERSION": "1.18",
+		"*.args.EXTRA":        "yes",
+		"app.tags":            "app:dev",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"GO_VERSION": "1.18", "DEBUG": "1", "EXTRA": "yes"}, tgt.Args)
+	require.Equal(t, []string{"app:dev"}, tgt.Tags)
+	require.Equal(t, "Dockerfile", *tgt.Dockerfile)
+
+	_, err = ResolveTarget(c, "app", map[string]string{"app": "foo"})
+	require.Error(t, err)
+
+	_, err = ResolveTarget(c, "missing", nil)
+	require.EqualError(t, err, "failed to find target missing")
+}
+
+func TestValidateConfig(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+  tags = ["foo:latest"]
+}
+target "app" {
+  inherits = ["base"]
+}
+target "other" {
+  tags = ["foo:latest", "other:latest"]
+}`),
+	}
+	c, err := ParseFiles([]File{fp}, nil)
+	require.NoError(t, err)
+	warnings, err := ValidateConfig(c)
+	require.NoError(t, err)
+	require.Equal(t, []Warning{{
+		Tag:     "docker.io/library/foo:latest",
+		Targets: []string{"app", "other"},
+	}}, warnings)
+	require.Equal(t, "tag docker.io/library/foo:latest is set by multiple targets and may be overwritten: app, other", warnings[0].String())
+
+	// inherited targets part of a group are built on their own
+	c.Groups = []*Group{{Name: "default", Targets: []string{"base"}}}
+	warnings, err = ValidateConfig(c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "base", "other"}, warnings[0].Targets)
+
+	fp.Data = []byte(`
+target "app" {
+  tags = ["foo:latest"]
+}
+target "other" {
+  tags = ["foo:1.0", "other:latest"]
+}`)
+	c, err = ParseFiles([]File{fp}, nil)
+	require.NoError(t, err)
+	warnings, err = ValidateConfig(c)
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+
+	fp.Data = []byte(`
+target "app" {
+  inherits = ["missing"]
+}`)
+	c, err = ParseFiles([]File{fp}, nil)
+	require.NoError(t, err)
+	_, err = ValidateConfig(c)
+	require.Error(t, err)
+}
+
+func TestSSHAgentWarnings(t *testing.T) {
+	m := map[string]*Target{
+		"app": {
+			SSH: []string{"default"},
+		},
+		"key": {
+			SSH: []string{"default=./id_rsa"},
+		},
+		"other": {
+			SSH: []string{"github"},
+		},
+		"none": {},
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	require.Equal(t, []string{
+		"target app: ssh default is requested but SSH_AUTH_SOCK is not set, no agent socket will be forwarded",
+	}, SSHAgentWarnings(m))
+
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/agent.sock")
+	require.Empty(t, SSHAgentWarnings(m))
+}
+
+func TestReadLocalFilesStdin(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "docker-bake.hcl")
+	require.NoError(t, os.WriteFile(fn, []byte(`
+target "webapp" {
+  dockerfile = "webapp.Dockerfile"
+}`), 0600))
+
+	stdin := bytes.NewReader([]byte(`
+services:
+  db:
+    build:
+      context: ./db
+  webapp:
+    build:
+      context: ./webapp
+      args:
+        VERSION: "2.0"
+`))
+
+	files, err := readLocalFiles([]string{fn, "-"}, stdin)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(files))
+	require.Equal(t, fn, files[0].Name)
+	require.Equal(t, "-", files[1].Name)
+
+	m, _, err := ReadTargets(context.TODO(), files, []string{"db", "webapp"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(m))
+	require.Equal(t, "./db", *m["db"].Context)
+	require.Equal(t, "./webapp", *m["webapp"].Context)
+	require.Equal(t, "webapp.Dockerfile", *m["webapp"].Dockerfile)
+	require.Equal(t, map[string]string{"VERSION": "2.0"}, m["webapp"].Args)
+
+	stdin = bytes.NewReader([]byte(`{"target": {"app": {"dockerfile": "app.Dockerfile"}}}`))
+	files, err = readLocalFiles([]string{"-"}, stdin)
+	require.NoError(t, err)
+	m, _, err = ReadTargets(context.TODO(), files, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "app.Dockerfile", *m["app"].Dockerfile)
+}
+
+func TestApplyCacheOnly(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+group "default" {
+  targets = ["app", "bin", "db", "none"]
+}
+
+target "app" {
+  tags = ["user/app:latest"]
+  push = true
+  cache-to = ["type=gha"]
+}
+
+target "bin" {
+  output = ["type=local,dest=./bin"]
+}
+
+target "db" {
+  load = true
+}
+
+target "none" {
+}`),
+	}
+
+	m, _, err := ReadTargets(context.TODO(), []File{fp}, []string{"default"}, nil, nil)
+	require.NoError(t, err)
+
+	ApplyCacheOnly(m)
+	for name, tgt := range m {
+		require.Equal(t, []string{"type=cacheonly"}, tgt.Outputs, name)
+		require.False(t, tgt.WillPush(), name)
+	}
+	require.Equal(t, []string{"type=gha"}, m["app"].CacheTo)
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	for name, opt := range bo {
+		require.Equal(t, 1, len(opt.Exports), name)
+		require.Equal(t, "cacheonly", opt.Exports[0].Type, name)
+	}
+}
+
+func TestReadTargetsGlob(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+group "api-all" {
+  targets = ["api-gateway", "api-worker"]
+}
+
+target "api-gateway" {
+}
+
+target "api-worker" {
+}
+
+target "web" {
+}`),
+	}
+
+	m, g, err := ReadTargets(context.TODO(), []File{fp}, []string{"api-*"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(m))
+	require.Contains(t, m, "api-gateway")
+	require.Contains(t, m, "api-worker")
+	require.Equal(t, 1, len(g))
+	require.Equal(t, []string{"api-gateway", "api-worker"}, g[0].Targets)
+
+	m, g, err = ReadTargets(context.TODO(), []File{fp}, []string{"w?b"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(m))
+	require.Contains(t, m, "web")
+	require.Equal(t, []string{"web"}, g[0].Targets)
+
+	_, _, err = ReadTargets(context.TODO(), []File{fp}, []string{"db-*"}, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, "could not find any target or group matching 'db-*'", err.Error())
+}
+
+func TestConfigMerge(t *testing.T) {
+	c, err := ParseFile([]byte(`
+group "default" {
+  targets = ["app"]
+}
+
+target "app" {
+  dockerfile = "Dockerfile"
+  args = {
+    FOO = "foo"
+  }
+  tags = ["user/app:latest"]
+  platforms = ["linux/amd64"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	other, err := ParseFile([]byte(`
+group "default" {
+  targets = ["app", "db"]
+}
+
+target "app" {
+  dockerfile = "app.Dockerfile"
+  args = {
+    BAR = "bar"
+  }
+  tags = ["user/app:1.0"]
+  platforms = ["!reset", "linux/arm64"]
+}
+
+target "db" {
+  context = "./db"
+}`), "docker-bake.override.hcl")
+	require.NoError(t, err)
+
+	require.NoError(t, c.Merge(other))
+	require.Equal(t, 1, len(c.Groups))
+	require.Equal(t, []string{"app", "db"}, c.Groups[0].Targets)
+	require.Equal(t, 2, len(c.Targets))
+
+	app := c.Targets[0]
+	require.Equal(t, "app", app.Name)
+	require.Equal(t, "app.Dockerfile", *app.Dockerfile)
+	require.Equal(t, map[string]string{"FOO": "foo", "BAR": "bar"}, app.Args)
+	require.Equal(t, []string{"user/app:latest", "user/app:1.0"}, app.Tags)
+	require.Equal(t, []string{"linux/arm64"}, app.Platforms)
+	require.Equal(t, "db", c.Targets[1].Name)
+	require.Equal(t, "./db", *c.Targets[1].Context)
+
+	// other is left untouched by changes to the merged config
+	*c.Targets[1].Context = "./other"
+	c.Groups[0].Targets[0] = "other"
+	require.Equal(t, "./db", *other.Targets[1].Context)
+	require.Equal(t, []string{"app", "db"}, other.Groups[0].Targets)
+
+	err = c.Merge(&Config{Groups: []*Group{{Name: "db", Targets: []string{"app"}}}})
+	require.Error(t, err)
+	require.Equal(t, "cannot merge target db with group of the same name", err.Error())
+}
+
+func TestBuildOptsByBuilder(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+group "default" {
+  targets = ["app", "arm", "tools"]
+}
+
+target "base" {
+  builder = "remote-arm"
+}
+
+target "app" {
+}
+
+target "arm" {
+  inherits = ["base"]
+}
+
+target "tools" {
+}`),
+	}
+
+	m, _, err := ReadTargets(context.TODO(), []File{fp}, []string{"default"}, []string{"tools.builder=remote-amd"}, nil)
+	require.NoError(t, err)
+	require.Nil(t, m["app"].Builder)
+	require.Equal(t, "remote-arm", *m["arm"].Builder)
+	require.Equal(t, "remote-amd", *m["tools"].Builder)
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	res, err := BuildOptsByBuilder(m, bo)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	for builder, names := range map[string][]string{
+		"":           {"app"},
+		"remote-arm": {"arm"},
+		"remote-amd": {"tools"},
+	} {
+		require.Equal(t, len(names), len(res[builder]), builder)
+		for _, name := range names {
+			require.Contains(t, res[builder], name)
+		}
+	}
+
+	tgts := TargetsByBuilder(m)
+	require.Equal(t, 3, len(tgts))
+	require.Equal(t, m["app"], tgts[""]["app"])
+	require.Equal(t, m["arm"], tgts["remote-arm"]["arm"])
+	require.Equal(t, m["tools"], tgts["remote-amd"]["tools"])
+
+	m["app"].Contexts = map[string]string{"arm": "target:arm"}
+	_, err = BuildOptsByBuilder(m, bo)
+	require.Error(t, err)
+	require.Equal(t, "target app cannot use target arm as named context as they are built by different builders", err.Error())
+}
+
+func TestDockerfileInlineConflict(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+  dockerfile = "app.Dockerfile"
+}
+
+target "app" {
+  inherits = ["base"]
+  dockerfile-inline = "FROM alpine\n"
+}
+
+target "inline" {
+  dockerfile-inline = "FROM alpine\n"
+}`),
+	}
+	ctx := context.TODO()
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"inline"}, nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, m["inline"].Dockerfile)
+	require.Equal(t, "FROM alpine\n", *m["inline"].DockerfileInline)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target app: dockerfile and dockerfile-inline are mutually exclusive, remove one of them")
+
+	tgt := &Target{
+		Dockerfile:       stringPtr("Dockerfile"),
+		DockerfileInline: stringPtr("FROM scratch"),
+	}
+	err = tgt.validate("both")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target both: dockerfile and dockerfile-inline are mutually exclusive")
+}
+
+func TestListTargets(t *testing.T) {
+	c, err := ParseFile([]byte(`
+group "default" {
+  description = "Build the app"
+  targets = ["app"]
+}
+
+group "all" {
+  targets = ["app", "db"]
+}
+
+target "db" {
+}
+
+target "app" {
+  description = "The web application"
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, []TargetInfo{
+		{Name: "all", Group: true},
+		{Name: "default", Group: true, Description: "Build the app"},
+		{Name: "app", Description: "The web application"},
+		{Name: "db"},
+	}, ListTargets(c))
+}
+
+func TestResolveTargetDedupePlatforms(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "base" {
+  platforms = ["linux/amd64", "linux/arm64"]
+}
+
+target "app" {
+  inherits = ["base"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+	c2, err := ParseFile([]byte(`
+target "base" {
+  platforms = ["linux/arm64/v8", "linux/amd64", "linux/arm/v7"]
+}`), "docker-bake.override.hcl")
+	require.NoError(t, err)
+	require.NoError(t, c.Merge(c2))
+
+	tgt, err := c.ResolveTarget("app", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64", "linux/arm/v7"}, tgt.Platforms)
+
+	o, err := c.newOverrides([]string{"app.platform=linux/arm,linux/arm/v7,linux/amd64"})
+	require.NoError(t, err)
+	tgt, err = c.ResolveTarget("app", o)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/arm", "linux/amd64"}, tgt.Platforms)
+
+	o, err = c.newOverrides([]string{"app.platform=linux/arm64/v8,linux/x86_64,linux/arm64"})
+	require.NoError(t, err)
+	tgt, err = c.ResolveTarget("app", o)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/arm64", "linux/amd64"}, tgt.Platforms)
+}
+
+func TestResolveTargetDedupeMatrixPlatforms(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+  platforms = ["linux/amd64", "linux/arm64"]
+}
+
+target "app" {
+  name = "app-${matrix.variant}"
+  inherits = ["base"]
+  matrix = {
+    variant = ["arm", "riscv"]
+  }
+  platforms = concat(target.base.platforms, matrix.variant == "arm" ? ["linux/arm64/v8", "linux/amd64"] : ["linux/riscv64"])
+}`),
+	}
+	ctx := context.TODO()
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app-arm", "app-riscv"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64"}, m["app-arm"].Platforms)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64", "linux/riscv64"}, m["app-riscv"].Platforms)
+}
+
+func TestTargetCall(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "check" {
+  call = "check"
+}
+
+target "unknown" {
+  call = "lint"
+}`),
+	}
+	ctx := context.TODO()
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"check"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "check", *m["check"].Call)
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, "lint", bo["check"].CallFunc)
+	require.Equal(t, "frontend.lint", m["check"].FrontendOpts()["requestid"])
+
+	m, _, err = ReadTargets(ctx, []File{fp}, []string{"check"}, []string{"check.call=build"}, nil)
+	require.NoError(t, err)
+	bo, err = TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, "", bo["check"].CallFunc)
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"unknown"}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `target unknown: invalid call "lint", expected one of build, check, outline or targets`)
+}
+
+func TestTargetsAffectedBy(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "api" {
+  context = "services/api"
+}
+
+target "web" {
+  context = "services/web"
+  dockerfile = "../../docker/web.Dockerfile"
+}
+
+target "webapp" {
+  context = "services/webapp"
+  contexts = {
+    web = "target:web"
+  }
+}
+
+target "remote" {
+  context = "https://github.com/docker/buildx.git"
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"api"}, c.TargetsAffectedBy([]string{"services/api/main.go"}))
+	require.Equal(t, []string{"web", "webapp"}, c.TargetsAffectedBy([]string{"services/web/index.html"}))
+	require.Equal(t, []string{"web", "webapp"}, c.TargetsAffectedBy([]string{"docker/web.Dockerfile"}))
+	require.Equal(t, []string{"webapp"}, c.TargetsAffectedBy([]string{"./services/webapp/app.js"}))
+	require.Empty(t, c.TargetsAffectedBy([]string{"services/apiv2/main.go", "README.md"}))
+}
+
+func TestReadTargetsGroupCycle(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+group "default" {
+  targets = ["a"]
+}
+
+group "a" {
+  targets = ["app", "b"]
+}
+
+group "b" {
+  targets = ["a"]
+}
+
+target "app" {
+}`),
+	}
+	ctx := context.TODO()
+
+	m, _, err := ReadTargets(ctx, []File{fp}, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(m))
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"default"}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cyclic group reference: a -> b -> a")
+
+	_, _, err = ReadTargets(ctx, []File{fp}, []string{"b*"}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cyclic group reference: b -> a -> b")
+}
@@ -3,15 +3,80 @@ package bake
 import (
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/compose-spec/compose-go/loader"
+	"github.com/compose-spec/compose-go/template"
 	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/go-units"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
 )
 
-func parseCompose(dt []byte) (*compose.Project, error) {
+var (
+	resolveRefPattern    = regexp.MustCompile(`(\$?)\$\{resolve:([^}]*)\}`)
+	secretFileRefPattern = regexp.MustCompile(`(\$?)\$\{secretfile:([^}]*)\}`)
+	replaceRefPattern    = regexp.MustCompile(`(\$?)\$\{([a-zA-Z_][a-zA-Z0-9_]*)(//?)([^/}]+)(?:/([^}]*))?\}`)
+
+	// composeSecretsDir is the only directory ${secretfile:name} references
+	// can be read from.
+	composeSecretsDir = "/run/secrets"
+)
+
+// Resolver resolves the values referenced with the ${resolve:key} syntax
+// in the build args of a compose file.
+type Resolver interface {
+	Resolve(key string) (string, error)
+}
+
+// nopResolver is the default resolver, resolving every key to an empty
+// string like an unset variable.
+type nopResolver struct{}
+
+func (nopResolver) Resolve(string) (string, error) {
+	return "", nil
+}
+
+// MissingVariableError is returned when a required variable referenced with
+// the ${VAR:?err} or ${VAR?err} syntax is not set in a compose file.
+type MissingVariableError struct {
+	// VarName is the name of the missing variable.
+	VarName string
+	// Service is the service referencing the variable, if any.
+	Service string
+	// Message is the error message set in the reference.
+	Message string
+}
+
+func (e *MissingVariableError) Error() string {
+	msg := "required variable " + e.VarName + " is missing a value"
+	if e.Service != "" {
+		msg += " in service " + e.Service
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func parseCompose(dt []byte, opt ComposeOpt, lenient bool) (*compose.Project, error) {
+	cfg, err := loadCompose(dt, opt, lenient)
+	var merr *MissingVariableError
+	if errors.As(err, &merr) {
+		merr.Service = composeFileVariableService(dt, merr.VarName)
+		return nil, merr
+	}
+	return cfg, err
+}
+
+func loadCompose(dt []byte, opt ComposeOpt, lenient bool) (*compose.Project, error) {
 	return loader.Load(compose.ConfigDetails{
 		ConfigFiles: []compose.ConfigFile{
 			{
@@ -21,7 +86,164 @@ func parseCompose(dt []byte) (*compose.Project, error) {
 		Environment: envMap(os.Environ()),
 	}, func(options *loader.Options) {
 		options.SkipNormalization = true
+		// consistency errors are reported per service in lenient mode
+		options.SkipConsistencyCheck = lenient
+		substitute := options.Interpolate.Substitute
+		options.Interpolate.Substitute = func(tmpl string, mapping template.Mapping) (string, error) {
+			// ${resolve:key} and ${secretfile:name} references are resolved
+			// in build args only, so keep them through interpolation
+			tmpl = keepRefs(tmpl, resolveRefPattern)
+			if opt.SecretFiles {
+				tmpl = keepRefs(tmpl, secretFileRefPattern)
+			}
+			res, err := substitute(replaceRefs(tmpl, mapping), mapping)
+			if err != nil {
+				return "", missingVariableError(err)
+			}
+			return res, nil
+		}
+	})
+}
+
+var missingVariablePattern = regexp.MustCompile(`^required variable ([^ ]+) is missing a value: (.*)$`)
+
+// missingVariableError converts the interpolation error of a required
+// variable to a MissingVariableError. Other errors are returned as is.
+func missingVariableError(err error) error {
+	terr, ok := err.(*template.InvalidTemplateError)
+	if !ok {
+		return err
+	}
+	m := missingVariablePattern.FindStringSubmatch(terr.Template)
+	if m == nil {
+		return err
+	}
+	return &MissingVariableError{VarName: m[1], Message: m[2]}
+}
+
+// composeFileVariableService returns the name of the first service of the
+// compose file referencing the required variable name.
+func composeFileVariableService(dt []byte, name string) string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(dt, &doc); err != nil || len(doc.Content) == 0 {
+		return ""
+	}
+	services := yamlMapValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return ""
+	}
+	var refs func(n *yaml.Node) bool
+	refs = func(n *yaml.Node) bool {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+		}
+		if n.Kind == yaml.ScalarNode {
+			return strings.Contains(n.Value, "${"+name+":?") || strings.Contains(n.Value, "${"+name+"?")
+		}
+		for _, c := range n.Content {
+			if refs(c) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		if refs(services.Content[i+1]) {
+			return services.Content[i].Value
+		}
+	}
+	return ""
+}
+
+// keepRefs escapes the references of tmpl matching pattern so they are
+// kept as is through interpolation.
+func keepRefs(tmpl string, pattern *regexp.Regexp) string {
+	return pattern.ReplaceAllStringFunc(tmpl, func(ref string) string {
+		return strings.Repeat("$", strings.Index(ref, "{")) + ref
+	})
+}
+
+// resolveRefs replaces ${resolve:key} references with the values returned by
+// the resolver. Escaped references ($${resolve:key}) are unescaped.
+func resolveRefs(v string, r Resolver) (string, error) {
+	var err error
+	res := resolveRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		m := resolveRefPattern.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref[1:]
+		}
+		if err != nil {
+			return ref
+		}
+		var val string
+		if val, err = r.Resolve(m[2]); err != nil {
+			err = errors.Wrapf(err, "failed to resolve %s", m[2])
+			return ref
+		}
+		return val
+	})
+	return res, err
+}
+
+// replaceRefs expands the ${VAR/find/replace} and ${VAR//find/replace}
+// references, replacing the first or all the occurrences of find in the
+// value of VAR. Occurrences are removed if replace is omitted. Unlike bash,
+// find is a literal string and not a pattern.
+// Escaped references ($${VAR/find/replace}) are left untouched.
+func replaceRefs(tmpl string, mapping template.Mapping) string {
+	return replaceRefPattern.ReplaceAllStringFunc(tmpl, func(ref string) string {
+		m := replaceRefPattern.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref
+		}
+		v, _ := mapping(m[2])
+		n := 1
+		if m[3] == "//" {
+			n = -1
+		}
+		// escape the value so it is not interpolated again
+		return strings.ReplaceAll(strings.Replace(v, m[4], m[5], n), "$", "$$")
+	})
+}
+
+// resolveSecretFileRefs replaces ${secretfile:name} references with the
+// content of the file name in composeSecretsDir, without trailing newlines.
+// Escaped references ($${secretfile:name}) are unescaped.
+func resolveSecretFileRefs(v string) (string, error) {
+	var err error
+	res := secretFileRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		m := secretFileRefPattern.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref[1:]
+		}
+		if err != nil {
+			return ref
+		}
+		var dt []byte
+		if dt, err = readComposeSecretFile(m[2]); err != nil {
+			return ref
+		}
+		return strings.TrimRight(string(dt), "\r\n")
 	})
+	return res, err
+}
+
+func readComposeSecretFile(name string) ([]byte, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, errors.Errorf("invalid secret file name %q", name)
+	}
+	dir, err := filepath.EvalSymlinks(composeSecretsDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read secret file %s", name)
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read secret file %s", name)
+	}
+	if filepath.Dir(p) != dir {
+		return nil, errors.Errorf("secret file %s is outside of %s", name, composeSecretsDir)
+	}
+	return os.ReadFile(p)
 }
 
 func envMap(env []string) map[string]string {
@@ -36,89 +258,1031 @@ func envMap(env []string) map[string]string {
 	return result
 }
 
+// ComposeOpt holds optional settings for ParseComposeWithOpt.
+type ComposeOpt struct {
+	// ServiceLabels copies service-level labels into the target labels.
+	// Labels defined in the build section take precedence on conflict.
+	ServiceLabels bool
+	// AbsContext resolves local build contexts to absolute paths relative
+	// to WorkingDir.
+	AbsContext bool
+	// WorkingDir is the directory of the compose file. Defaults to the
+	// current working directory.
+	WorkingDir string
+	// Resolver resolves ${resolve:key} references in build args. If not
+	// set, these references resolve to an empty string.
+	Resolver Resolver
+	// StrictSecretEnv fails parsing if the environment variable backing a
+	// build secret is not set. By default it is only looked up at build time.
+	StrictSecretEnv bool
+	// SecretFiles resolves ${secretfile:name} references in build args to
+	// the content of /run/secrets/name.
+	SecretFiles bool
+	// DependsOnContexts sets a named context pointing at the target of each
+	// built service a service depends on, named after the dependency and its
+	// image, so FROM instructions referencing them use the built result.
+	DependsOnContexts bool
+	// Profiles are the active compose profiles. Services with profiles are
+	// only included in the default group if one of them is active, while
+	// services without profiles are always included. Services of inactive
+	// profiles remain available as targets to build them explicitly.
+	Profiles []string
+}
+
 func ParseCompose(dt []byte) (*Config, error) {
-	cfg, err := parseCompose(dt)
+	return ParseComposeWithOpt(dt, ComposeOpt{})
+}
+
+func ParseComposeWithOpt(dt []byte, opt ComposeOpt) (*Config, error) {
+	c, _, err := parseComposeConfig(dt, opt, false)
+	return c, err
+}
+
+// ParseComposeLenient parses a compose file like ParseComposeWithOpt but
+// skips the services that cannot be converted to a target instead of
+// failing. The errors of the skipped services are returned alongside the
+// config holding the other targets.
+func ParseComposeLenient(dt []byte, opt ComposeOpt) (*Config, []error, error) {
+	return parseComposeConfig(dt, opt, true)
+}
+
+func parseComposeConfig(dt []byte, opt ComposeOpt, lenient bool) (*Config, []error, error) {
+	dt, services, buildFields, err := composeRewrite(dt, opt.WorkingDir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	cfg, err := parseCompose(dt, opt, lenient)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	var c Config
-	var zeroBuildConfig compose.BuildConfig
+	var errs []error
 	if len(cfg.Services) > 0 {
 		c.Groups = []*Group{}
 		c.Targets = []*Target{}
 
 		g := &Group{Name: "default"}
+		argsOrder := composeFileArgsOrder(services)
+		shmSizes := composeFileShmSizes(services)
 
 		for _, s := range cfg.Services {
+			// services of inactive profiles are only built when requested,
+			// so they don't fail the parsing of the file
+			active := composeServiceActive(s, opt.Profiles)
+			t, err := composeServiceToTarget(cfg, s, opt)
+			if err != nil {
+				if !active {
+					continue
+				}
+				if !lenient {
+					return nil, nil, err
+				}
+				errs = append(errs, err)
+				continue
+			}
+			if t == nil {
+				continue
+			}
+			t.ArgsOrder = composeArgsOrder(argsOrder[s.Name], t.Args)
+			for _, k := range composeDuplicateArgs(argsOrder[s.Name]) {
+				c.Warnings = append(c.Warnings, fmt.Sprintf("service %s: build arg %s is defined multiple times, the last value is used", s.Name, k))
+			}
+			if s.Platform != "" && (len(t.Platforms) != 1 || t.Platforms[0] != s.Platform) {
+				c.Warnings = append(c.Warnings, fmt.Sprintf("service %s: platform %s is ignored in favor of x-bake platforms %s", s.Name, s.Platform, strings.Join(t.Platforms, ",")))
+			}
+			t.Ulimits = buildFields[s.Name].ulimits
+			var ts []*Target
+			err = composeSetShmSize(t, cfg, shmSizes[s.Name])
+			if err == nil {
+				err = composeSetContexts(t, cfg, buildFields[s.Name].contexts, opt)
+			}
+			if err == nil {
+				ts, err = composeExpandContextGlob(s, t, opt)
+			}
+			if err != nil {
+				if !active {
+					continue
+				}
+				if !lenient {
+					return nil, nil, err
+				}
+				errs = append(errs, err)
+				continue
+			}
+			for _, t := range ts {
+				if active {
+					g.Targets = append(g.Targets, t.Name)
+				}
+				c.Targets = append(c.Targets, t)
+			}
+		}
+		seen := map[string]struct{}{}
+		for _, t := range c.Targets {
+			if _, ok := seen[t.Name]; ok {
+				return nil, nil, errors.Errorf("compose file invalid: duplicate target %s", t.Name)
+			}
+			seen[t.Name] = struct{}{}
+		}
+		c.Groups = append(c.Groups, g)
+
+		if opt.DependsOnContexts {
+			composeSetDependsOnContexts(cfg, &c)
+		}
 
-			if s.Build == nil || reflect.DeepEqual(s.Build, zeroBuildConfig) {
-				// if not make sure they're setting an image or it's invalid d-c.yml
-				if s.Image == "" {
-					return nil, fmt.Errorf("compose file invalid: service %s has neither an image nor a build context specified. At least one must be provided", s.Name)
+		// services are loaded in map order
+		c.Sort()
+	}
+
+	return &c, errs, nil
+}
+
+// composeServiceActive returns true if s has no profiles or one of them is
+// in profiles.
+func composeServiceActive(s compose.ServiceConfig, profiles []string) bool {
+	if len(s.Profiles) == 0 {
+		return true
+	}
+	for _, p := range s.Profiles {
+		for _, active := range profiles {
+			if p == active {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// composeServiceToTarget converts a compose service to a bake target. It
+// returns a nil target if the service has nothing to build.
+func composeServiceToTarget(cfg *compose.Project, s compose.ServiceConfig, opt ComposeOpt) (*Target, error) {
+	var zeroBuildConfig compose.BuildConfig
+	if s.Build == nil || reflect.DeepEqual(s.Build, zeroBuildConfig) {
+		// if not make sure they're setting an image or it's invalid d-c.yml
+		if s.Image == "" {
+			return nil, fmt.Errorf("compose file invalid: service %s has neither an image nor a build context specified. At least one must be provided", s.Name)
+		}
+		return nil, nil
+	}
+
+	if err := validateTargetName(s.Name); err != nil {
+		return nil, errors.Wrapf(err, "invalid service name %q", s.Name)
+	}
+
+	var contextPathP *string
+	if s.Build.Context != "" {
+		contextPath := s.Build.Context
+		if opt.AbsContext {
+			var err error
+			if contextPath, err = composeAbsContext(contextPath, opt.WorkingDir); err != nil {
+				return nil, err
+			}
+		}
+		contextPathP = &contextPath
+	}
+	var dockerfilePathP *string
+	if s.Build.Dockerfile != "" {
+		dockerfilePath := s.Build.Dockerfile
+		dockerfilePathP = &dockerfilePath
+	}
+
+	for _, tag := range s.Build.Tags {
+		// digest-pinned references (name@sha256:...) are valid tags too
+		if _, err := reference.Parse(tag); err != nil {
+			return nil, errors.Wrapf(err, "compose file invalid: invalid tag %q for service %s", tag, s.Name)
+		}
+	}
+
+	if err := composeValidateSecretTargets(s.Name, s.Build.Secrets); err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for _, bs := range s.Build.Secrets {
+		secret, err := composeToBuildkitSecret(bs, cfg.Secrets[bs.Source])
+		if err != nil {
+			return nil, err
+		} else if secret == "" {
+			continue
+		}
+		if env := cfg.Secrets[bs.Source].Environment; opt.StrictSecretEnv && env != "" {
+			if _, ok := os.LookupEnv(env); !ok {
+				return nil, errors.Errorf("environment variable %s for secret %s of service %s is not set", env, bs.Source, s.Name)
+			}
+		}
+		secrets = append(secrets, secret)
+	}
+
+	args := flatten(s.Build.Args.Resolve(func(val string) (string, bool) {
+		if val, ok := s.Environment[val]; ok && val != nil {
+			return *val, true
+		}
+		val, ok := cfg.Environment[val]
+		return val, ok
+	}))
+	resolver := opt.Resolver
+	if resolver == nil {
+		resolver = nopResolver{}
+	}
+	for k, v := range args {
+		v, err := resolveRefs(v, resolver)
+		if err == nil && opt.SecretFiles {
+			v, err = resolveSecretFileRefs(v)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid build arg %s for service %s", k, s.Name)
+		}
+		args[k] = v
+	}
+
+	t := &Target{
+		Name:        s.Name,
+		Context:     contextPathP,
+		Dockerfile:  dockerfilePathP,
+		Tags:        s.Build.Tags,
+		Labels:      composeLabels(s, opt),
+		Args:        args,
+		CacheFrom:   s.Build.CacheFrom,
+		CacheTo:     s.Build.CacheTo,
+		NetworkMode: &s.Build.Network,
+		Secrets:     secrets,
+		ExtraHosts:  composeExtraHosts(s),
+	}
+	if err := t.composeExtTarget(s.Build.Extensions); err != nil {
+		return nil, err
+	}
+	if s.Platform != "" && len(t.Platforms) == 0 {
+		t.Platforms = []string{s.Platform}
+	}
+	merged, err := composeMergeSecrets(s.Name, secrets, t.Secrets[len(secrets):])
+	if err != nil {
+		return nil, err
+	}
+	t.Secrets = merged
+	if s.Build.Target != "" {
+		target := s.Build.Target
+		t.Target = &target
+	}
+	if len(t.Tags) == 0 && s.Image != "" {
+		t.Tags = []string{s.Image}
+	}
+	return t, nil
+}
+
+// composeExtraHosts returns the host-to-IP mappings of the service build as
+// sorted host:ip entries, falling back to the service ones.
+func composeExtraHosts(s compose.ServiceConfig) []string {
+	hosts := s.Build.ExtraHosts
+	if len(hosts) == 0 {
+		hosts = s.ExtraHosts
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	res := hosts.AsList()
+	sort.Strings(res)
+	return res
+}
+
+// composeFileArgsOrder returns the names of the build args of each of the
+// services in the order they are written in the compose file.
+func composeFileArgsOrder(services *yaml.Node) map[string][]string {
+	if services == nil || services.Kind != yaml.MappingNode {
+		return nil
+	}
+	res := map[string][]string{}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		args := yamlMapValue(yamlMapValue(services.Content[i+1], "build"), "args")
+		if args == nil {
+			continue
+		}
+		var keys []string
+		switch args.Kind {
+		case yaml.MappingNode:
+			for j := 0; j < len(args.Content); j += 2 {
+				keys = append(keys, args.Content[j].Value)
+			}
+		case yaml.SequenceNode:
+			for _, n := range args.Content {
+				keys = append(keys, strings.SplitN(n.Value, "=", 2)[0])
+			}
+		}
+		res[services.Content[i].Value] = keys
+	}
+	return res
+}
+
+// composeDuplicateArgs returns the names of the args defined multiple times in
+// the list form of build.args, in the order they are first defined.
+func composeDuplicateArgs(keys []string) []string {
+	count := make(map[string]int, len(keys))
+	var res []string
+	for _, k := range keys {
+		count[k]++
+		if count[k] == 2 {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// composeFileShmSizes returns the build shm_size of each service as written
+// in the compose file, as it is not loaded by compose-go.
+func composeFileShmSizes(services *yaml.Node) map[string]string {
+	if services == nil || services.Kind != yaml.MappingNode {
+		return nil
+	}
+	res := map[string]string{}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		v := yamlMapValue(yamlMapValue(services.Content[i+1], "build"), "shm_size")
+		if v != nil && v.Kind == yaml.ScalarNode {
+			res[services.Content[i].Value] = v.Value
+		}
+	}
+	return res
+}
+
+// composeSetShmSize sets the shm size of t to v, interpolated and normalized
+// to bytes. Both byte counts and human readable sizes like 128mb are accepted.
+func composeSetShmSize(t *Target, cfg *compose.Project, v string) error {
+	if v == "" {
+		return nil
+	}
+	v, err := template.Substitute(v, func(k string) (string, bool) {
+		val, ok := cfg.Environment[k]
+		return val, ok
+	})
+	if err != nil {
+		return errors.Wrapf(err, "invalid shm_size for service %s", t.Name)
+	}
+	size, err := units.RAMInBytes(v)
+	if err != nil {
+		return errors.Wrapf(err, "invalid shm_size for service %s", t.Name)
+	}
+	shmSize := strconv.FormatInt(size, 10)
+	t.ShmSize = &shmSize
+	return nil
+}
+
+// composeRewrite rewrites dt for the features that the compose-go version in
+// use doesn't support: it resolves the includes, substitutes the service
+// names of the build tags, renames the source key of the secrets and extracts
+// the unsupported build fields. The file is parsed once and only marshaled
+// again if it changed. The services node of the rewritten file is returned
+// along with it.
+func composeRewrite(dt []byte, dir string) ([]byte, *yaml.Node, map[string]composeBuildFields, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(dt, &doc); err != nil || len(doc.Content) == 0 {
+		// let compose report invalid files
+		return dt, nil, nil, nil
+	}
+	changed, err := composeResolveIncludes(doc.Content[0], dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if root, ok := composeSubstituteServiceNames(doc.Content[0]); ok {
+		doc.Content[0] = root
+		changed = true
+	}
+	ok, err := composeNormalizeSecretSources(doc.Content[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	changed = changed || ok
+	services := yamlMapValue(doc.Content[0], "services")
+	buildFields, err := composeExtractBuildFields(services)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(buildFields) > 0 {
+		changed = true
+	}
+	if changed {
+		if dt, err = yaml.Marshal(&doc); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return dt, services, buildFields, nil
+}
+
+// composeBuildFields holds the build fields of a service that are not
+// supported by the compose-go schema.
+type composeBuildFields struct {
+	// ulimits in the name=soft:hard format
+	ulimits []string
+	// additional contexts, not interpolated yet
+	contexts map[string]string
+}
+
+// composeExtractBuildFields removes the build fields of each of the services
+// that are not supported by the compose-go schema and returns them.
+// Ulimits accept both the short form, setting the soft and hard limits to the
+// same value, and the long form with soft and hard keys. Additional contexts
+// accept both the mapping and the list of name=value forms.
+func composeExtractBuildFields(services *yaml.Node) (map[string]composeBuildFields, error) {
+	if services == nil || services.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	res := map[string]composeBuildFields{}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name := services.Content[i].Value
+		build := yamlMapValue(services.Content[i+1], "build")
+		if build == nil {
+			continue
+		}
+		var fields composeBuildFields
+		found := false
+		for j := 0; j+1 < len(build.Content); {
+			var err error
+			switch build.Content[j].Value {
+			case "ulimits":
+				fields.ulimits, err = composeUlimits(name, build.Content[j+1])
+			case "additional_contexts":
+				fields.contexts, err = composeAdditionalContexts(name, build.Content[j+1])
+			default:
+				j += 2
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			found = true
+			build.Content = append(build.Content[:j], build.Content[j+2:]...)
+		}
+		if found {
+			res[name] = fields
+		}
+	}
+	return res, nil
+}
+
+var serviceNameRefPattern = regexp.MustCompile(`\$\$|\$\{(service|target)\}|\$(service|target)\b`)
+
+// composeSubstituteServiceNames replaces the ${service} and ${target}
+// references of the build tags of each service with the name of the service,
+// before compose interpolates them. A reference to a variable set in the
+// environment is left to the interpolation. If a reference is found, the
+// root node is returned with its aliases expanded, so tags shared by services
+// are substituted for each of them, otherwise root is returned unchanged.
+func composeSubstituteServiceNames(root *yaml.Node) (*yaml.Node, bool) {
+	var names []string
+	for _, name := range []string{"service", "target"} {
+		if _, ok := os.LookupEnv(name); !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return root, false
+	}
+	expanded := yamlExpandAliases(root)
+	services := yamlMapValue(expanded, "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return root, false
+	}
+	replace := func(v, name string) string {
+		return serviceNameRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+			for _, n := range names {
+				if ref == "${"+n+"}" || ref == "$"+n {
+					return name
 				}
+			}
+			return ref
+		})
+	}
+	changed := false
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name := services.Content[i].Value
+		build := yamlMapValue(services.Content[i+1], "build")
+		if build == nil || build.Kind != yaml.MappingNode {
+			continue
+		}
+		tags := yamlMapValue(build, "tags")
+		if tags == nil {
+			// tags set through a merge key are copied to the build section
+			// to be substituted for this service only
+			if tags = yamlMergedValue(build, "tags"); tags == nil {
 				continue
 			}
+			build.Content = append(build.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "tags"}, tags)
+		}
+		for _, tag := range tags.Content {
+			if v := replace(tag.Value, name); v != tag.Value {
+				tag.Value = v
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return root, false
+	}
+	// references left in top-level extensions, typically holding the
+	// anchors of the tags, are escaped to not be interpolated
+	var escape func(n *yaml.Node)
+	escape = func(n *yaml.Node) {
+		for _, c := range n.Content {
+			escape(c)
+		}
+		if n.Kind == yaml.ScalarNode {
+			n.Value = serviceNameRefPattern.ReplaceAllStringFunc(n.Value, func(ref string) string {
+				return replace(ref, "$"+ref)
+			})
+		}
+	}
+	for i := 0; i+1 < len(expanded.Content); i += 2 {
+		if strings.HasPrefix(expanded.Content[i].Value, "x-") {
+			escape(expanded.Content[i+1])
+		}
+	}
+	return expanded, true
+}
 
-			if err = validateTargetName(s.Name); err != nil {
-				return nil, errors.Wrapf(err, "invalid service name %q", s.Name)
+// composeNormalizeSecretSources renames the source key of the top-level
+// secrets of root to file, as some compose files use it as an alias of file
+// that compose rejects. It returns whether a secret was renamed.
+func composeNormalizeSecretSources(root *yaml.Node) (bool, error) {
+	secrets := yamlMapValue(root, "secrets")
+	if secrets == nil || secrets.Kind != yaml.MappingNode {
+		return false, nil
+	}
+	changed := false
+	for i := 0; i+1 < len(secrets.Content); i += 2 {
+		secret := secrets.Content[i+1]
+		if secret.Kind == yaml.AliasNode {
+			secret = secret.Alias
+		}
+		if secret.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(secret.Content); j += 2 {
+			if secret.Content[j].Value != "source" {
+				continue
 			}
+			if yamlMapValue(secret, "file") != nil {
+				return false, errors.Errorf("compose file invalid: secret %s sets both file and source", secrets.Content[i].Value)
+			}
+			secret.Content[j].Value = "file"
+			changed = true
+		}
+	}
+	return changed, nil
+}
 
-			var contextPathP *string
-			if s.Build.Context != "" {
-				contextPath := s.Build.Context
-				contextPathP = &contextPath
+// yamlMergedValue returns the value of key in the mappings merged into n
+// with the << merge key, if any.
+func yamlMergedValue(n *yaml.Node, key string) *yaml.Node {
+	merge := yamlMapValue(n, "<<")
+	if merge == nil {
+		return nil
+	}
+	if merge.Kind == yaml.SequenceNode {
+		for _, m := range merge.Content {
+			if v := yamlMapValue(m, key); v != nil {
+				return v
 			}
-			var dockerfilePathP *string
-			if s.Build.Dockerfile != "" {
-				dockerfilePath := s.Build.Dockerfile
-				dockerfilePathP = &dockerfilePath
+		}
+		return nil
+	}
+	return yamlMapValue(merge, key)
+}
+
+// composeResolveIncludes merges the compose files listed by the top-level
+// include element of root into it, as the compose-go version in use does not
+// support it. Relative include paths are resolved against dir, the directory
+// of the compose file, and the relative paths of the included files are
+// rebased on their own directory. Resources of an included file cannot
+// conflict with the ones of the including file. It returns whether root
+// includes any file.
+func composeResolveIncludes(root *yaml.Node, dir string) (bool, error) {
+	if yamlMapValue(root, "include") == nil {
+		return false, nil
+	}
+	if err := composeInclude(root, dir, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func composeInclude(root *yaml.Node, dir string, stack []string) error {
+	var include *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "include" {
+			include = root.Content[i+1]
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			break
+		}
+	}
+	if include == nil {
+		return nil
+	}
+	paths, err := composeIncludePaths(include)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fn := p
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(dir, fn)
+		}
+		abs, err := filepath.Abs(fn)
+		if err != nil {
+			return err
+		}
+		for _, s := range stack {
+			if s == abs {
+				return errors.Errorf("compose file invalid: include cycle detected with %s", p)
 			}
+		}
+		dt, err := os.ReadFile(fn)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read included compose file %s", p)
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(dt, &doc); err != nil {
+			return errors.Wrapf(err, "failed to parse included compose file %s", p)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		// anchors are scoped to their file
+		n := yamlExpandAliases(doc.Content[0])
+		if n.Kind != yaml.MappingNode {
+			return errors.Errorf("compose file invalid: included file %s must be a mapping", p)
+		}
+		if err := composeInclude(n, filepath.Dir(fn), append(stack, abs)); err != nil {
+			return err
+		}
+		composeRebaseIncluded(n, filepath.Dir(p))
+		if err := composeMergeIncluded(root, n, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			var secrets []string
-			for _, bs := range s.Build.Secrets {
-				secret, err := composeToBuildkitSecret(bs, cfg.Secrets[bs.Source])
-				if err != nil {
-					return nil, err
+// composeIncludePaths returns the paths listed by include, in the short
+// syntax or with the path key of the long syntax.
+func composeIncludePaths(include *yaml.Node) ([]string, error) {
+	if include.Kind != yaml.SequenceNode {
+		return nil, errors.Errorf("compose file invalid: include must be a list")
+	}
+	var paths []string
+	for _, n := range include.Content {
+		switch n.Kind {
+		case yaml.ScalarNode:
+			paths = append(paths, n.Value)
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if k := n.Content[i].Value; k != "path" {
+					return nil, errors.Errorf("compose file invalid: unsupported include field %s", k)
+				}
+				v := n.Content[i+1]
+				if v.Kind == yaml.ScalarNode {
+					paths = append(paths, v.Value)
+					continue
+				}
+				for _, p := range v.Content {
+					paths = append(paths, p.Value)
 				}
-				secrets = append(secrets, secret)
 			}
+		default:
+			return nil, errors.Errorf("compose file invalid: include entries must be a path or a mapping")
+		}
+	}
+	return paths, nil
+}
 
-			g.Targets = append(g.Targets, s.Name)
-			t := &Target{
-				Name:       s.Name,
-				Context:    contextPathP,
-				Dockerfile: dockerfilePathP,
-				Tags:       s.Build.Tags,
-				Labels:     s.Build.Labels,
-				Args: flatten(s.Build.Args.Resolve(func(val string) (string, bool) {
-					if val, ok := s.Environment[val]; ok && val != nil {
-						return *val, true
+// composeRebaseIncluded prefixes the relative build contexts, env files and
+// secret files of the included compose file n with base. Secret files set
+// with the source alias are rebased too, as the alias is normalized once the
+// includes are resolved.
+func composeRebaseIncluded(n *yaml.Node, base string) {
+	if base == "." {
+		return
+	}
+	rebase := func(v *yaml.Node) {
+		p := v.Value
+		if p == "" || filepath.IsAbs(p) || strings.HasPrefix(p, "$") || IsRemoteURL(p) || strings.Contains(p, "://") {
+			return
+		}
+		v.Value = filepath.Join(base, p)
+	}
+	if services := yamlMapValue(n, "services"); services != nil && services.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(services.Content); i += 2 {
+			s := services.Content[i+1]
+			if build := yamlMapValue(s, "build"); build != nil {
+				switch build.Kind {
+				case yaml.ScalarNode:
+					rebase(build)
+				case yaml.MappingNode:
+					if c := yamlMapValue(build, "context"); c != nil {
+						rebase(c)
+					} else {
+						build.Content = append(build.Content,
+							&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "context"},
+							&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: base})
 					}
-					val, ok := cfg.Environment[val]
-					return val, ok
-				})),
-				CacheFrom:   s.Build.CacheFrom,
-				NetworkMode: &s.Build.Network,
-				Secrets:     secrets,
-			}
-			if err = t.composeExtTarget(s.Build.Extensions); err != nil {
-				return nil, err
+				}
 			}
-			if s.Build.Target != "" {
-				target := s.Build.Target
-				t.Target = &target
+			if envFile := yamlMapValue(s, "env_file"); envFile != nil {
+				if envFile.Kind == yaml.ScalarNode {
+					rebase(envFile)
+				}
+				for _, v := range envFile.Content {
+					rebase(v)
+				}
 			}
-			if len(t.Tags) == 0 && s.Image != "" {
-				t.Tags = []string{s.Image}
+		}
+	}
+	if secrets := yamlMapValue(n, "secrets"); secrets != nil && secrets.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(secrets.Content); i += 2 {
+			for _, k := range []string{"file", "source"} {
+				if f := yamlMapValue(secrets.Content[i+1], k); f != nil {
+					rebase(f)
+				}
 			}
-			c.Targets = append(c.Targets, t)
 		}
-		c.Groups = append(c.Groups, g)
+	}
+}
+
+// composeMergeIncluded adds the resources of the included compose file n to
+// root. Other top-level elements already set by root are kept.
+func composeMergeIncluded(root, n *yaml.Node, fn string) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, val := n.Content[i].Value, n.Content[i+1]
+		existing := yamlMapValue(root, key)
+		if existing == nil {
+			root.Content = append(root.Content, n.Content[i], val)
+			continue
+		}
+		switch key {
+		case "services", "networks", "volumes", "secrets", "configs":
+		default:
+			continue
+		}
+		if existing.Kind != yaml.MappingNode || val.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(val.Content); j += 2 {
+			name := val.Content[j].Value
+			if yamlMapValue(existing, name) != nil {
+				return errors.Errorf("compose file invalid: %s %s of included file %s conflicts with the including file", strings.TrimSuffix(key, "s"), name, fn)
+			}
+			existing.Content = append(existing.Content, val.Content[j], val.Content[j+1])
+		}
+	}
+	return nil
+}
+
+// yamlExpandAliases returns a copy of n with aliases replaced by a copy of
+// the node they refer to and anchors removed.
+func yamlExpandAliases(n *yaml.Node) *yaml.Node {
+	if n.Kind == yaml.AliasNode {
+		return yamlExpandAliases(n.Alias)
+	}
+	c := *n
+	c.Anchor = ""
+	if len(n.Content) > 0 {
+		c.Content = make([]*yaml.Node, len(n.Content))
+		for i, v := range n.Content {
+			c.Content[i] = yamlExpandAliases(v)
+		}
+	}
+	return &c
+}
+
+func composeAdditionalContexts(service string, n *yaml.Node) (map[string]string, error) {
+	res := map[string]string{}
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			res[n.Content[i].Value] = n.Content[i+1].Value
+		}
+	case yaml.SequenceNode:
+		for _, v := range n.Content {
+			kv := strings.SplitN(v.Value, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, errors.Errorf("compose file invalid: additional context %s of service %s must be in the name=value format", v.Value, service)
+			}
+			res[kv[0]] = kv[1]
+		}
+	default:
+		return nil, errors.Errorf("compose file invalid: additional_contexts of service %s must be a mapping or a list", service)
+	}
+	return res, nil
+}
+
+// composeSetDependsOnContexts sets a target:name context on the target of
+// each service for its dependencies built by a target of c, named after the
+// dependency and, if set, its image. Contexts already set are kept.
+func composeSetDependsOnContexts(cfg *compose.Project, c *Config) {
+	targets := make(map[string]*Target, len(c.Targets))
+	for _, t := range c.Targets {
+		targets[t.Name] = t
+	}
+	for _, s := range cfg.Services {
+		t, ok := targets[s.Name]
+		if !ok || len(s.DependsOn) == 0 {
+			continue
+		}
+		deps := make([]string, 0, len(s.DependsOn))
+		for dep := range s.DependsOn {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if _, ok := targets[dep]; !ok || dep == t.Name {
+				continue
+			}
+			names := []string{dep}
+			if ds, err := cfg.GetService(dep); err == nil && ds.Image != "" {
+				names = append(names, ds.Image)
+			}
+			for _, name := range names {
+				if _, ok := t.Contexts[name]; ok {
+					continue
+				}
+				if t.Contexts == nil {
+					t.Contexts = map[string]string{}
+				}
+				t.Contexts[name] = "target:" + dep
+			}
+		}
+	}
+}
+
+// composeSetContexts sets the named contexts of t to the interpolated
+// additional contexts. Local ones are made absolute with opt.AbsContext.
+func composeSetContexts(t *Target, cfg *compose.Project, contexts map[string]string, opt ComposeOpt) error {
+	for k, v := range contexts {
+		v, err := template.Substitute(v, func(k string) (string, bool) {
+			val, ok := cfg.Environment[k]
+			return val, ok
+		})
+		if err != nil {
+			return errors.Wrapf(err, "invalid additional context %s for service %s", k, t.Name)
+		}
+		if opt.AbsContext && !strings.HasPrefix(v, "target:") && !strings.HasPrefix(v, "docker-image:") && !strings.HasPrefix(v, "oci-layout:") {
+			if v, err = composeAbsContext(v, opt.WorkingDir); err != nil {
+				return err
+			}
+		}
+		if t.Contexts == nil {
+			t.Contexts = map[string]string{}
+		}
+		t.Contexts[k] = v
+	}
+	return nil
+}
+
+func composeUlimits(service string, n *yaml.Node) ([]string, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, errors.Errorf("compose file invalid: ulimits of service %s must be a mapping", service)
+	}
+	var res []string
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		name, v := n.Content[i].Value, n.Content[i+1]
+		var soft, hard string
+		switch v.Kind {
+		case yaml.ScalarNode:
+			soft, hard = v.Value, v.Value
+		case yaml.MappingNode:
+			if s := yamlMapValue(v, "soft"); s != nil {
+				soft = s.Value
+			}
+			if h := yamlMapValue(v, "hard"); h != nil {
+				hard = h.Value
+			}
+		}
+		for _, l := range []string{soft, hard} {
+			if _, err := strconv.ParseInt(l, 10, 64); err != nil {
+				return nil, errors.Errorf("compose file invalid: ulimit %s of service %s must be an integer or define soft and hard integer limits", name, service)
+			}
+		}
+		res = append(res, name+"="+soft+":"+hard)
+	}
+	sort.Strings(res)
+	return res, nil
+}
 
+// yamlMapValue returns the value of key in the mapping node n, if any.
+func yamlMapValue(n *yaml.Node, key string) *yaml.Node {
+	if n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			v := n.Content[i+1]
+			if v.Kind == yaml.AliasNode {
+				v = v.Alias
+			}
+			return v
+		}
 	}
+	return nil
+}
 
-	return &c, nil
+// composeArgsOrder returns the names of args ordered as in the compose file,
+// followed by the remaining ones, e.g. from x-bake args-default, sorted.
+func composeArgsOrder(fileOrder []string, args map[string]string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	order := make([]string, 0, len(args))
+	for _, k := range fileOrder {
+		if _, ok := args[k]; ok && !sliceContains(order, k) {
+			order = append(order, k)
+		}
+	}
+	var rest []string
+	for k := range args {
+		if !sliceContains(order, k) {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(order, rest...)
+}
+
+// composeExpandContextGlob returns a copy of t for each directory matching the
+// x-bake context-glob pattern of the service, named after the directory. The
+// target is returned as is if the service does not define a pattern.
+func composeExpandContextGlob(s compose.ServiceConfig, t *Target, opt ComposeOpt) ([]*Target, error) {
+	ext, ok := s.Build.Extensions["x-bake"].(map[string]interface{})
+	if !ok {
+		return []*Target{t}, nil
+	}
+	v, ok := ext["context-glob"]
+	if !ok {
+		return []*Target{t}, nil
+	}
+	pattern, ok := v.(string)
+	if !ok {
+		return nil, errors.Errorf("compose file invalid: x-bake context-glob of service %s must be a string", s.Name)
+	}
+
+	wd := opt.WorkingDir
+	if wd == "" {
+		wd = "."
+	}
+	matches, err := filepath.Glob(filepath.Join(wd, pattern))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid context-glob %s for service %s", pattern, s.Name)
+	}
+
+	var ts []*Target
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err != nil || !fi.IsDir() {
+			continue
+		}
+		name := filepath.Base(m)
+		if err := validateTargetName(name); err != nil {
+			return nil, errors.Wrapf(err, "invalid target name %q generated by context-glob of service %s", name, s.Name)
+		}
+		contextPath := m
+		if opt.AbsContext {
+			if contextPath, err = composeAbsContext(m, opt.WorkingDir); err != nil {
+				return nil, err
+			}
+		}
+		td := t.clone()
+		td.Name = name
+		td.Context = &contextPath
+		ts = append(ts, td)
+	}
+	if len(ts) == 0 {
+		return nil, errors.Errorf("context-glob %s of service %s does not match any directory", pattern, s.Name)
+	}
+	return ts, nil
+}
+
+func composeAbsContext(contextPath, wd string) (string, error) {
+	if IsRemoteURL(contextPath) || filepath.IsAbs(contextPath) {
+		return contextPath, nil
+	}
+	if wd == "" {
+		var err error
+		if wd, err = os.Getwd(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Abs(filepath.Join(wd, contextPath))
+}
+
+func composeLabels(s compose.ServiceConfig, opt ComposeOpt) map[string]string {
+	if !opt.ServiceLabels || len(s.Labels) == 0 {
+		return s.Build.Labels
+	}
+	labels := make(map[string]string, len(s.Labels)+len(s.Build.Labels))
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	for k, v := range s.Build.Labels {
+		labels[k] = v
+	}
+	return labels
 }
 
 func flatten(in compose.MappingWithEquals) compose.Mapping {
@@ -149,6 +1313,14 @@ func (t *Target) composeExtTarget(exts map[string]interface{}) error {
 						t.Tags = append(t.Tags, res.(string))
 					}
 				}
+			case "annotations":
+				if res, k := val.(string); k {
+					t.Annotations = append(t.Annotations, res)
+				} else {
+					for _, res := range val.([]interface{}) {
+						t.Annotations = append(t.Annotations, res.(string))
+					}
+				}
 			case "cache-from":
 				t.CacheFrom = []string{} // Needed to override the main field
 				if res, k := val.(string); k {
@@ -190,6 +1362,7 @@ func (t *Target) composeExtTarget(exts map[string]interface{}) error {
 						t.Platforms = append(t.Platforms, res.(string))
 					}
 				}
+				t.Platforms = splitPlatforms(t.Platforms)
 			case "output":
 				if res, k := val.(string); k {
 					t.Outputs = append(t.Outputs, res)
@@ -206,6 +1379,40 @@ func (t *Target) composeExtTarget(exts map[string]interface{}) error {
 				if res, ok := val.(bool); ok {
 					t.NoCache = &res
 				}
+			case "push":
+				if res, ok := val.(bool); ok {
+					t.Push = &res
+				}
+			case "load":
+				if res, ok := val.(bool); ok {
+					t.Load = &res
+				}
+			case "args-default":
+				// lowest precedence args, only set if not defined by
+				// build.args or the environment. Overrides are applied later.
+				res, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("compose file invalid: x-bake args-default must be a map")
+				}
+				for k, v := range res {
+					if _, ok := t.Args[k]; ok {
+						continue
+					}
+					if t.Args == nil {
+						t.Args = map[string]string{}
+					}
+					t.Args[k] = fmt.Sprint(v)
+				}
+			case "call":
+				if res, ok := val.(string); ok {
+					t.Call = &res
+				}
+			case "description":
+				if res, ok := val.(string); ok {
+					t.Description = &res
+				}
+			case "context-glob":
+				// expanded into multiple targets by composeExpandContextGlob
 			case "no-cache-filter":
 				if res, k := val.(string); k {
 					t.NoCacheFilter = append(t.NoCacheFilter, res)
@@ -214,6 +1421,14 @@ func (t *Target) composeExtTarget(exts map[string]interface{}) error {
 						t.NoCacheFilter = append(t.NoCacheFilter, res.(string))
 					}
 				}
+			case "entitlements":
+				if res, k := val.(string); k {
+					t.Entitlements = append(t.Entitlements, res)
+				} else {
+					for _, res := range val.([]interface{}) {
+						t.Entitlements = append(t.Entitlements, res.(string))
+					}
+				}
 			default:
 				return fmt.Errorf("compose file invalid: unkwown %s field for x-bake", key)
 			}
@@ -222,16 +1437,103 @@ func (t *Target) composeExtTarget(exts map[string]interface{}) error {
 	return nil
 }
 
+// composeMergeSecrets returns the build secrets of a service followed by the
+// x-bake ones. The ids must be unique within each source and an x-bake secret
+// overrides a build secret with the same id.
+func composeMergeSecrets(name string, secrets, xbake []string) ([]string, error) {
+	if err := validateSecretIDs(name, secrets); err != nil {
+		return nil, err
+	}
+	if err := validateSecretIDs(name, xbake); err != nil {
+		return nil, err
+	}
+	if len(xbake) == 0 {
+		return secrets, nil
+	}
+	overridden := map[string]struct{}{}
+	for _, s := range xbake {
+		id, _ := parseOutputAttr(s, "id")
+		overridden[id] = struct{}{}
+	}
+	res := make([]string, 0, len(secrets)+len(xbake))
+	for _, s := range secrets {
+		id, _ := parseOutputAttr(s, "id")
+		if _, ok := overridden[id]; !ok {
+			res = append(res, s)
+		}
+	}
+	return append(res, xbake...), nil
+}
+
+// composeValidateSecretTargets checks that the secrets of a service are not
+// mounted at the same path.
+func composeValidateSecretTargets(name string, secrets []compose.ServiceSecretConfig) error {
+	targets := map[string]string{}
+	for _, bs := range secrets {
+		target := composeSecretTarget(bs)
+		if other, ok := targets[target]; ok {
+			return errors.Errorf("compose file invalid: secrets %s and %s of service %s are both mounted at %s", other, bs.Source, name, target)
+		}
+		targets[target] = bs.Source
+	}
+	return nil
+}
+
+// composeSecretTarget returns the path where the secret gets mounted. Like
+// compose, relative targets are relative to /run/secrets.
+func composeSecretTarget(bs compose.ServiceSecretConfig) string {
+	target := bs.Target
+	if target == "" {
+		target = bs.Source
+	}
+	if !path.IsAbs(target) {
+		target = path.Join("/run/secrets", target)
+	}
+	return path.Clean(target)
+}
+
+// composeSecretID returns the id of the build secret. Like the mount path, it
+// is renamed by the target of the reference if set.
+func composeSecretID(bs compose.ServiceSecretConfig) string {
+	if bs.Target != "" {
+		return path.Base(bs.Target)
+	}
+	return bs.Source
+}
+
 // composeToBuildkitSecret converts secret from compose format to buildkit's
 // csv format.
 func composeToBuildkitSecret(inp compose.ServiceSecretConfig, psecret compose.SecretConfig) (string, error) {
 	if psecret.External.External {
-		return "", errors.Errorf("unsupported external secret %s", psecret.Name)
+		// external secrets are managed outside of the compose file, so only
+		// the id is set and the secret is looked up from the environment
+		// variable or file with the same name at build time. The id is not
+		// renamed by the target as the secret would not be found anymore.
+		if inp.Source == "" {
+			return "", errors.Errorf("compose file invalid: external secret %s has no source", psecret.Name)
+		}
+		return "id=" + inp.Source, nil
+	}
+
+	// Compose spec does not define a required field for build secrets yet so
+	// rely on the x-required extension. If the secret is optional and its
+	// source is missing, the secret is skipped and an empty string returned.
+	if v, ok := inp.Extensions["x-required"]; ok {
+		required, ok := v.(bool)
+		if !ok {
+			return "", errors.Errorf("compose file invalid: x-required for secret %s must be a boolean", inp.Source)
+		}
+		if !composeSecretSourceExists(psecret) {
+			if required {
+				return "", errors.Errorf("source for required secret %s not found", inp.Source)
+			}
+			return "", nil
+		}
 	}
 
 	var bkattrs []string
-	if inp.Source != "" {
-		bkattrs = append(bkattrs, "id="+inp.Source)
+	if id := composeSecretID(inp); id != "" {
+		bkattrs = append(bkattrs, "id="+id)
 	}
 	if psecret.File != "" {
 		bkattrs = append(bkattrs, "src="+psecret.File)
@@ -242,3 +1544,17 @@ func composeToBuildkitSecret(inp compose.ServiceSecretConfig, psecret compose.Se
 
 	return strings.Join(bkattrs, ","), nil
 }
+
+func composeSecretSourceExists(psecret compose.SecretConfig) bool {
+	if psecret.File != "" {
+		if _, err := os.Stat(psecret.File); err != nil {
+			return false
+		}
+	}
+	if psecret.Environment != "" {
+		if _, ok := os.LookupEnv(psecret.Environment); !ok {
+			return false
+		}
+	}
+	return true
+}
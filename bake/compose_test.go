@@ -1,10 +1,15 @@
 package bake
 
 import (
+	"context"
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 
+	"github.com/moby/buildkit/util/entitlements"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -26,11 +31,15 @@ services:
       secrets:
         - token
         - aws
+        - source: npmrc
+          target: othername
 secrets:
   token:
     environment: ENV_TOKEN
   aws:
     file: /root/.aws/credentials
+  npmrc:
+    file: /root/.npmrc
 `)
 
 	c, err := ParseCompose(dt)
@@ -58,6 +67,7 @@ secrets:
 	require.Equal(t, []string{
 		"id=token,env=ENV_TOKEN",
 		"id=aws,src=/root/.aws/credentials",
+		"id=othername,src=/root/.npmrc",
 	}, c.Targets[1].Secrets)
 }
 
@@ -153,6 +163,37 @@ services:
 	require.Equal(t, c.Targets[0].Args["BRB"], "FOO")
 }
 
+func TestContextEnvCompose(t *testing.T) {
+	var dt = []byte(`
+services:
+  long:
+    build:
+      context: ${APP_DIR}/service
+      dockerfile: ${APP_DIR}/service/Dockerfile
+  short:
+    build: ${APP_DIR}/short
+  default:
+    build:
+      context: ${APP_UNSET_DIR:-./default}
+`)
+
+	os.Setenv("APP_DIR", "/src/app")
+	defer os.Unsetenv("APP_DIR")
+	os.Unsetenv("APP_UNSET_DIR")
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(c.Targets))
+	m := map[string]*Target{}
+	for _, t := range c.Targets {
+		m[t.Name] = t
+	}
+	require.Equal(t, "/src/app/service", *m["long"].Context)
+	require.Equal(t, "/src/app/service/Dockerfile", *m["long"].Dockerfile)
+	require.Equal(t, "/src/app/short", *m["short"].Context)
+	require.Equal(t, "./default", *m["default"].Context)
+}
+
 func TestBogusCompose(t *testing.T) {
 	var dt = []byte(`
 services:
@@ -195,6 +236,334 @@ networks:
 	require.NoError(t, err)
 }
 
+func TestExtraHosts(t *testing.T) {
+	var dt = []byte(`
+services:
+  db:
+    networks:
+      - example.com
+    build:
+      context: ./db
+      target: db
+      extra_hosts:
+        - "somehost:162.242.195.82"
+        - "myhostv6:10.5.0.10"
+  webapp:
+    extra_hosts:
+      otherhost: 50.31.209.229
+    build:
+      context: ./web
+
+networks:
+  example.com:
+    name: example.com
+    driver: bridge
+    ipam:
+      config:
+        - subnet: 10.5.0.0/24
+          ip_range: 10.5.0.0/24
+          gateway: 10.5.0.254
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	sort.Slice(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+	require.Equal(t, []string{"myhostv6:10.5.0.10", "somehost:162.242.195.82"}, c.Targets[0].ExtraHosts)
+	require.Equal(t, []string{"otherhost:50.31.209.229"}, c.Targets[1].ExtraHosts)
+
+	dt, err = json.Marshal(map[string]interface{}{
+		"target": map[string]*Target{"db": c.Targets[0]},
+	})
+	require.NoError(t, err)
+	c, err = ParseFile(dt, "docker-bake.json")
+	require.NoError(t, err)
+	require.Equal(t, []string{"myhostv6:10.5.0.10", "somehost:162.242.195.82"}, c.Targets[0].ExtraHosts)
+
+	c, err = ParseFile([]byte(`
+target "db" {
+  add-hosts = ["myhostv6:10.5.0.10", "somehost:162.242.195.82"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+	require.Equal(t, []string{"myhostv6:10.5.0.10", "somehost:162.242.195.82"}, c.Targets[0].ExtraHosts)
+
+	bo, err := TargetsToBuildOpt(map[string]*Target{"db": c.Targets[0]}, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"myhostv6:10.5.0.10", "somehost:162.242.195.82"}, bo["db"].ExtraHosts)
+}
+
+func TestComposeShmSize(t *testing.T) {
+	var dt = []byte(`
+services:
+  human:
+    build:
+      context: .
+      shm_size: 256mb
+  bytes:
+    build:
+      context: .
+      shm_size: 1048576
+  env:
+    build:
+      context: .
+      shm_size: ${BAKE_TEST_SHM_SIZE}
+  none:
+    build: .
+`)
+
+	os.Setenv("BAKE_TEST_SHM_SIZE", "2g")
+	defer os.Unsetenv("BAKE_TEST_SHM_SIZE")
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(c.Targets))
+	m := map[string]*Target{}
+	for _, t := range c.Targets {
+		m[t.Name] = t
+	}
+	require.Equal(t, "268435456", *m["human"].ShmSize)
+	require.Equal(t, "1048576", *m["bytes"].ShmSize)
+	require.Equal(t, "2147483648", *m["env"].ShmSize)
+	require.Nil(t, m["none"].ShmSize)
+
+	bo, err := TargetsToBuildOpt(map[string]*Target{"human": m["human"]}, &Input{})
+	require.NoError(t, err)
+	shmSize := bo["human"].ShmSize
+	require.Equal(t, int64(268435456), shmSize.Value())
+
+	_, err = ParseCompose([]byte(`
+services:
+  app:
+    build:
+      context: .
+      shm_size: lots
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid shm_size for service app")
+}
+
+func TestComposeAdditionalContexts(t *testing.T) {
+	t.Setenv("BAKE_TEST_ALPINE_VERSION", "3.16")
+	var dt = []byte(`
+services:
+  base:
+    build:
+      context: ./base
+  webapp:
+    build:
+      context: .
+      additional_contexts:
+        alpine: docker-image://alpine:${BAKE_TEST_ALPINE_VERSION}
+        src: ./src
+        base: target:base
+  db:
+    build:
+      context: ./db
+      additional_contexts:
+        - src=./db/src
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(c.Targets))
+	require.Nil(t, c.Targets[0].Contexts)
+	require.Equal(t, "db", c.Targets[1].Name)
+	require.Equal(t, map[string]string{"src": "./db/src"}, c.Targets[1].Contexts)
+	require.Equal(t, "webapp", c.Targets[2].Name)
+	require.Equal(t, map[string]string{
+		"alpine": "docker-image://alpine:3.16",
+		"src":    "./src",
+		"base":   "target:base",
+	}, c.Targets[2].Contexts)
+
+	m, _, err := ReadTargets(context.TODO(), []File{
+		{Name: "docker-compose.yml", Data: dt},
+		{Name: "docker-bake.hcl", Data: []byte(`
+target "webapp" {
+  contexts = {
+    alpine = "docker-image://alpine:edge"
+    cache = "./cache"
+  }
+}`)},
+	}, []string{"webapp"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"alpine": "docker-image://alpine:edge",
+		"src":    "./src",
+		"base":   "target:base",
+		"cache":  "./cache",
+	}, m["webapp"].Contexts)
+
+	_, err = ParseCompose([]byte(`
+services:
+  webapp:
+    build:
+      context: .
+      additional_contexts:
+        - src
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "additional context src of service webapp must be in the name=value format")
+}
+
+func TestComposeUlimits(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      ulimits:
+        nproc: 65535
+        nofile:
+          soft: 1024
+          hard: 2048
+        mylimit: 10
+  db:
+    build: ./db
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	m := map[string]*Target{}
+	for _, t := range c.Targets {
+		m[t.Name] = t
+	}
+	require.Equal(t, []string{"mylimit=10:10", "nofile=1024:2048", "nproc=65535:65535"}, m["app"].Ulimits)
+	require.Nil(t, m["db"].Ulimits)
+
+	// unknown limits are passed through for the builder to validate
+	bo, err := TargetsToBuildOpt(map[string]*Target{"app": {Ulimits: m["app"].Ulimits}}, &Input{})
+	require.NoError(t, err)
+	ulimits := map[string]string{}
+	for _, u := range bo["app"].Ulimits.GetList() {
+		ulimits[u.Name] = u.String()
+	}
+	require.Equal(t, map[string]string{"mylimit": "mylimit=10:10", "nofile": "nofile=1024:2048", "nproc": "nproc=65535:65535"}, ulimits)
+
+	_, err = TargetsToBuildOpt(map[string]*Target{"app": {Ulimits: []string{"nofile=2048:1024"}}}, &Input{})
+	require.Error(t, err)
+	_, err = TargetsToBuildOpt(map[string]*Target{"app": {Ulimits: []string{"nofile"}}}, &Input{})
+	require.Error(t, err)
+
+	_, err = ParseCompose([]byte(`
+services:
+  app:
+    build:
+      context: .
+      ulimits:
+        nofile:
+          soft: 1024
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ulimit nofile of service app")
+}
+
+func TestComposeServicePlatform(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    platform: linux/arm64
+    build:
+      context: .
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, []string{"linux/arm64"}, c.Targets[0].Platforms)
+}
+
+func TestComposeDuplicateArgs(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      args:
+        - FOO=1
+        - BAR=bar
+        - FOO=2
+  db:
+    build:
+      context: ./db
+      args:
+        FOO: 1
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, map[string]string{"FOO": "2", "BAR": "bar"}, c.Targets[0].Args)
+	require.Equal(t, []string{"FOO", "BAR"}, c.Targets[0].ArgsOrder)
+	require.Equal(t, []string{"service app: build arg FOO is defined multiple times, the last value is used"}, c.Warnings)
+
+	_, _, warnings, err := ReadTargetsWithOpt(context.TODO(), []File{{Name: "docker-compose.yml", Data: dt}}, []string{"default"}, nil, ReadOpt{})
+	require.NoError(t, err)
+	require.Equal(t, c.Warnings, warnings)
+}
+
+func TestComposeServicePlatformConflict(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    platform: linux/arm64
+    build:
+      context: .
+      x-bake:
+        platforms:
+          - linux/amd64
+          - linux/arm64
+  same:
+    platform: linux/arm64
+    build:
+      context: .
+      x-bake:
+        platforms: linux/arm64
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, []string{"linux/amd64", "linux/arm64"}, c.Targets[0].Platforms)
+	require.Equal(t, []string{"linux/arm64"}, c.Targets[1].Platforms)
+	require.Equal(t, []string{"service app: platform linux/arm64 is ignored in favor of x-bake platforms linux/amd64,linux/arm64"}, c.Warnings)
+}
+
+func TestComposeStableOrder(t *testing.T) {
+	var dt = []byte(`
+services:
+  webapp:
+    build: ./web
+  db:
+    build: ./db
+  cache:
+    build: ./cache
+  api:
+    build: ./api
+  worker:
+    build: ./worker
+`)
+
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		c, err := ParseCompose(dt)
+		require.NoError(t, err)
+		out, err := json.Marshal(c)
+		require.NoError(t, err)
+		if expected == nil {
+			expected = out
+			require.Equal(t, []string{"api", "cache", "db", "webapp", "worker"}, c.Groups[0].Targets)
+			require.Equal(t, "api", c.Targets[0].Name)
+			require.Equal(t, "worker", c.Targets[4].Name)
+			continue
+		}
+		require.Equal(t, expected, out)
+	}
+}
+
 func TestTags(t *testing.T) {
 	var dt = []byte(`
 services:
@@ -275,6 +644,7 @@ services:
           - type=local,src=path/to/cache
         cache-to: local,dest=path/to/cache
         pull: true
+        push: true
 
   aws:
     image: ct-fake-aws:bar
@@ -305,6 +675,7 @@ services:
 	require.Equal(t, c.Targets[0].CacheFrom, []string{"type=local,src=path/to/cache"})
 	require.Equal(t, c.Targets[0].CacheTo, []string{"local,dest=path/to/cache"})
 	require.Equal(t, c.Targets[0].Pull, newBool(true))
+	require.Equal(t, c.Targets[0].Push, newBool(true))
 	require.Equal(t, c.Targets[1].Tags, []string{"ct-fake-aws:bar"})
 	require.Equal(t, c.Targets[1].Secrets, []string{"id=mysecret,src=/local/secret", "id=mysecret2,src=/local/secret2"})
 	require.Equal(t, c.Targets[1].SSH, []string{"default"})
@@ -313,66 +684,352 @@ services:
 	require.Equal(t, c.Targets[1].NoCache, newBool(true))
 }
 
-func TestEnv(t *testing.T) {
-	envf, err := os.CreateTemp("", "env")
-	require.NoError(t, err)
-	defer os.Remove(envf.Name())
+func TestComposeCacheTo(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      cache_to:
+        - registry,ref=user/app:cache
+  ext:
+    build:
+      context: .
+      cache_to:
+        - registry,ref=user/ext:cache
+      x-bake:
+        cache-to: type=local,dest=path/to/cache
+`)
 
-	_, err = envf.WriteString("FOO=bsdf -csdf\n")
+	c, err := ParseCompose(dt)
 	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	sort.Slice(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+	require.Equal(t, []string{"registry,ref=user/app:cache"}, c.Targets[0].CacheTo)
+	require.Equal(t, []string{"registry,ref=user/ext:cache", "type=local,dest=path/to/cache"}, c.Targets[1].CacheTo)
+}
 
+func TestComposeExtCall(t *testing.T) {
 	var dt = []byte(`
 services:
-  scratch:
+  app:
     build:
-     context: .
-     args:
-        CT_ECR: foo
-        FOO:
-        NODE_ENV:
-    environment:
-      - NODE_ENV=test
-      - AWS_ACCESS_KEY_ID=dummy
-      - AWS_SECRET_ACCESS_KEY=dummy
-    env_file:
-      - ` + envf.Name() + `
+      context: .
+      x-bake:
+        call: check
 `)
 
 	c, err := ParseCompose(dt)
 	require.NoError(t, err)
-	require.Equal(t, c.Targets[0].Args, map[string]string{"CT_ECR": "foo", "FOO": "bsdf -csdf", "NODE_ENV": "test"})
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, "check", *c.Targets[0].Call)
 }
 
-func TestPorts(t *testing.T) {
+func TestComposeExtDescription(t *testing.T) {
 	var dt = []byte(`
 services:
-  foo:
+  app:
     build:
-     context: .
-    ports:
-      - 3306:3306
-  bar:
+      context: .
+      x-bake:
+        description: The web application
+  db:
     build:
-     context: .
-    ports:
-      - mode: ingress
-        target: 3306
-        published: "3306"
-        protocol: tcp
+      context: .
 `)
-	_, err := ParseCompose(dt)
+
+	c, err := ParseCompose(dt)
 	require.NoError(t, err)
+	require.Equal(t, []TargetInfo{
+		{Name: "default", Group: true},
+		{Name: "app", Description: "The web application"},
+		{Name: "db"},
+	}, ListTargets(c))
 }
 
-func newBool(val bool) *bool {
-	b := val
-	return &b
-}
+func TestComposeExtAnnotations(t *testing.T) {
+	var dt = []byte(`
+services:
+  addon:
+    image: ct-addon:bar
+    build:
+      context: .
+      x-bake:
+        annotations:
+          - index:org.opencontainers.image.source=https://github.com/docker/buildx
+          - org.opencontainers.image.title=addon
+  aws:
+    image: ct-fake-aws:bar
+    build:
+      context: .
+      x-bake:
+        annotations: manifest[linux/arm64]:com.example.id=aws
+`)
 
-func TestServiceName(t *testing.T) {
-	cases := []struct {
-		svc     string
-		wantErr bool
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	sort.Slice(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+	require.Equal(t, []string{
+		"index:org.opencontainers.image.source=https://github.com/docker/buildx",
+		"org.opencontainers.image.title=addon",
+	}, c.Targets[0].Annotations)
+	require.Equal(t, []string{"manifest[linux/arm64]:com.example.id=aws"}, c.Targets[1].Annotations)
+
+	m, _, err := ReadTargets(context.TODO(), []File{
+		{Name: "docker-compose.yml", Data: dt},
+		{Name: "docker-bake.hcl", Data: []byte(`
+target "addon" {
+  annotations = ["org.opencontainers.image.vendor=docker"]
+}`)},
+	}, []string{"addon"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"index:org.opencontainers.image.source=https://github.com/docker/buildx",
+		"org.opencontainers.image.title=addon",
+		"org.opencontainers.image.vendor=docker",
+	}, m["addon"].Annotations)
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"annotation-index.org.opencontainers.image.source": "https://github.com/docker/buildx",
+		"annotation.org.opencontainers.image.title":        "addon",
+		"annotation.org.opencontainers.image.vendor":       "docker",
+	}, bo["addon"].Annotations)
+}
+
+func TestComposeExtNoCacheFilter(t *testing.T) {
+	var dt = []byte(`
+services:
+  addon:
+    build:
+      context: .
+      x-bake:
+        no-cache-filter:
+          - base
+          - deps
+  aws:
+    build:
+      context: .
+      x-bake:
+        no-cache-filter: base
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, "addon", c.Targets[0].Name)
+	require.Equal(t, []string{"base", "deps"}, c.Targets[0].NoCacheFilter)
+	require.Equal(t, "aws", c.Targets[1].Name)
+	require.Equal(t, []string{"base"}, c.Targets[1].NoCacheFilter)
+
+	m, _, err := ReadTargets(context.TODO(), []File{
+		{Name: "docker-compose.yml", Data: dt},
+		{Name: "docker-bake.hcl", Data: []byte(`
+target "addon" {
+  no-cache-filter = ["deps", "release"]
+}`)},
+	}, []string{"addon"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"base", "deps", "release"}, m["addon"].NoCacheFilter)
+}
+
+func TestComposeExtEntitlements(t *testing.T) {
+	var dt = []byte(`
+services:
+  addon:
+    build:
+      context: .
+      x-bake:
+        entitlements:
+          - security.insecure
+          - network.host
+  aws:
+    build:
+      context: .
+      x-bake:
+        entitlements: network.host
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, []string{"security.insecure", "network.host"}, c.Targets[0].Entitlements)
+	require.Equal(t, []string{"network.host"}, c.Targets[1].Entitlements)
+
+	m, _, err := ReadTargets(context.TODO(), []File{
+		{Name: "docker-compose.yml", Data: dt},
+		{Name: "docker-bake.hcl", Data: []byte(`
+target "aws" {
+  entitlements = ["security.insecure"]
+}`)},
+	}, []string{"addon", "aws"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"network.host", "security.insecure"}, m["aws"].Entitlements)
+
+	bo, err := TargetsToBuildOpt(m, &Input{})
+	require.NoError(t, err)
+	require.Equal(t, []entitlements.Entitlement{entitlements.EntitlementSecurityInsecure, entitlements.EntitlementNetworkHost}, bo["addon"].Allow)
+
+	_, _, err = ReadTargets(context.TODO(), []File{{Name: "docker-compose.yml", Data: []byte(`
+services:
+  addon:
+    build:
+      context: .
+      x-bake:
+        entitlements: device
+`)}}, []string{"addon"}, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, "target addon: invalid entitlement: device", err.Error())
+}
+
+func TestEnv(t *testing.T) {
+	envf, err := os.CreateTemp("", "env")
+	require.NoError(t, err)
+	defer os.Remove(envf.Name())
+
+	_, err = envf.WriteString("FOO=bsdf -csdf\n")
+	require.NoError(t, err)
+
+	var dt = []byte(`
+services:
+  scratch:
+    build:
+     context: .
+     args:
+        CT_ECR: foo
+        FOO:
+        NODE_ENV:
+    environment:
+      - NODE_ENV=test
+      - AWS_ACCESS_KEY_ID=dummy
+      - AWS_SECRET_ACCESS_KEY=dummy
+    env_file:
+      - ` + envf.Name() + `
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, c.Targets[0].Args, map[string]string{"CT_ECR": "foo", "FOO": "bsdf -csdf", "NODE_ENV": "test"})
+}
+
+func TestEnvQuoted(t *testing.T) {
+	envf, err := os.CreateTemp("", "env")
+	require.NoError(t, err)
+	defer os.Remove(envf.Name())
+
+	_, err = envf.WriteString(`# comment
+FOO="bar baz"
+BAR='single'
+export UNQUOTED=plain value # comment
+ESCAPED="a \"quoted\" \\ value\n\$HOME"
+LITERAL='no \n ${FOO}'
+REF="${FOO}!"
+MULTI="line1
+line2"
+OVERRIDDEN="from file"
+`)
+	require.NoError(t, err)
+
+	var dt = []byte(`
+services:
+  scratch:
+    build:
+     context: .
+     args:
+        FOO:
+        BAR:
+        UNQUOTED:
+        ESCAPED:
+        LITERAL:
+        REF:
+        MULTI:
+        OVERRIDDEN:
+    environment:
+      - OVERRIDDEN=from environment
+    env_file:
+      - ` + envf.Name() + `
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"FOO":        "bar baz",
+		"BAR":        "single",
+		"UNQUOTED":   "plain value",
+		"ESCAPED":    "a \"quoted\" \\ value\n$HOME",
+		"LITERAL":    `no \n ${FOO}`,
+		"REF":        "bar baz!",
+		"MULTI":      "line1\nline2",
+		"OVERRIDDEN": "from environment",
+	}, c.Targets[0].Args)
+}
+
+func TestComposeMissingVariable(t *testing.T) {
+	var dt = []byte(`
+services:
+  db:
+    build:
+      context: .
+      args:
+        VERSION: ${VERSION:-latest}
+  webapp:
+    build:
+      context: .
+      args:
+        TOKEN: ${BAKE_TEST_TOKEN:?token must be set}
+`)
+
+	_, err := ParseCompose(dt)
+	require.Error(t, err)
+	var merr *MissingVariableError
+	require.ErrorAs(t, err, &merr)
+	require.Equal(t, "BAKE_TEST_TOKEN", merr.VarName)
+	require.Equal(t, "webapp", merr.Service)
+	require.Equal(t, "token must be set", merr.Message)
+	require.Equal(t, "required variable BAKE_TEST_TOKEN is missing a value in service webapp: token must be set", err.Error())
+
+	t.Setenv("BAKE_TEST_TOKEN", "foo")
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"TOKEN": "foo"}, c.Targets[1].Args)
+}
+
+func TestPorts(t *testing.T) {
+	var dt = []byte(`
+services:
+  foo:
+    build:
+     context: .
+    ports:
+      - 3306:3306
+  bar:
+    build:
+     context: .
+    ports:
+      - mode: ingress
+        target: 3306
+        published: "3306"
+        protocol: tcp
+`)
+	_, err := ParseCompose(dt)
+	require.NoError(t, err)
+}
+
+func newBool(val bool) *bool {
+	b := val
+	return &b
+}
+
+func TestServiceName(t *testing.T) {
+	cases := []struct {
+		svc     string
+		wantErr bool
 	}{
 		{
 			svc:     "a",
@@ -420,3 +1077,1020 @@ services:
 		})
 	}
 }
+
+func TestComposeBuildLabels(t *testing.T) {
+	t.Setenv("BAKE_TEST_GIT_SHA", "0123456789abcdef")
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      labels:
+        org.opencontainers.image.title: app
+        org.opencontainers.image.revision: ${BAKE_TEST_GIT_SHA}
+  db:
+    build:
+      context: ./db
+      labels:
+        - org.opencontainers.image.title=db
+        - org.opencontainers.image.revision=${BAKE_TEST_GIT_SHA}
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	for _, tgt := range c.Targets {
+		require.Equal(t, map[string]string{
+			"org.opencontainers.image.title":    tgt.Name,
+			"org.opencontainers.image.revision": "0123456789abcdef",
+		}, tgt.Labels)
+	}
+}
+
+func TestComposeBuildLabelsDefault(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      labels:
+        version: "${BAKE_TEST_LABEL_VERSION:-dev}"
+        title: "${BAKE_TEST_LABEL_TITLE-app}"
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"version": "dev", "title": "app"}, c.Targets[0].Labels)
+
+	t.Setenv("BAKE_TEST_LABEL_VERSION", "1.0")
+	t.Setenv("BAKE_TEST_LABEL_TITLE", "")
+	c, err = ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"version": "1.0", "title": ""}, c.Targets[0].Labels)
+
+	_, err = ParseCompose([]byte(`
+services:
+  app:
+    build:
+      context: .
+      labels:
+        revision: "${BAKE_TEST_LABEL_REVISION:?revision is required}"
+`))
+	var merr *MissingVariableError
+	require.ErrorAs(t, err, &merr)
+	require.Equal(t, "BAKE_TEST_LABEL_REVISION", merr.VarName)
+	require.Equal(t, "app", merr.Service)
+}
+
+func TestComposeDependsOnContexts(t *testing.T) {
+	var dt = []byte(`
+services:
+  base:
+    image: myorg/base:latest
+    build:
+      context: ./base
+  tools:
+    build:
+      context: ./tools
+  db:
+    image: postgres
+  app:
+    build:
+      context: ./app
+      additional_contexts:
+        tools: docker-image://myorg/tools:1.0
+    depends_on:
+      - base
+      - db
+      - tools
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, "app", c.Targets[0].Name)
+	require.Equal(t, map[string]string{"tools": "docker-image://myorg/tools:1.0"}, c.Targets[0].Contexts)
+
+	c, err = ParseComposeWithOpt(dt, ComposeOpt{DependsOnContexts: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(c.Targets))
+	require.Equal(t, "app", c.Targets[0].Name)
+	require.Equal(t, map[string]string{
+		"base":              "target:base",
+		"myorg/base:latest": "target:base",
+		"tools":             "docker-image://myorg/tools:1.0",
+	}, c.Targets[0].Contexts)
+	require.Equal(t, "base", c.Targets[1].Name)
+	require.Nil(t, c.Targets[1].Contexts)
+}
+
+func TestComposeProfiles(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: ./app
+  debug:
+    build:
+      context: ./debug
+    profiles:
+      - debug
+  docs:
+    build:
+      context: ./docs
+    profiles:
+      - docs
+      - release
+`)
+
+	for _, tt := range []struct {
+		name     string
+		profiles []string
+		targets  []string
+	}{
+		{"none", nil, []string{"app"}},
+		{"one", []string{"debug"}, []string{"app", "debug"}},
+		{"multiple", []string{"debug", "release"}, []string{"app", "debug", "docs"}},
+		{"unknown", []string{"test"}, []string{"app"}},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseComposeWithOpt(dt, ComposeOpt{Profiles: tt.profiles})
+			require.NoError(t, err)
+			require.Equal(t, 3, len(c.Targets))
+			require.Equal(t, 1, len(c.Groups))
+			require.Equal(t, tt.targets, c.Groups[0].Targets)
+		})
+	}
+
+	ctx := context.TODO()
+	fp := File{Name: "docker-compose.yml", Data: dt}
+
+	m, g, _, err := ReadTargetsWithOpt(ctx, []File{fp}, []string{"default"}, nil, ReadOpt{ParseOpt: ParseOpt{Profiles: []string{"docs"}}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "docs"}, g[0].Targets)
+	require.Equal(t, 2, len(m))
+
+	m, _, _, err = ReadTargetsWithOpt(ctx, []File{fp}, []string{"debug"}, nil, ReadOpt{})
+	require.NoError(t, err)
+	require.Equal(t, "./debug", *m["debug"].Context)
+}
+
+func TestComposeServiceLabels(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      labels:
+        com.example.foo: build
+    labels:
+      com.example.foo: service
+      com.example.bar: service
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"com.example.foo": "build"}, c.Targets[0].Labels)
+
+	c, err = ParseComposeWithOpt(dt, ComposeOpt{ServiceLabels: true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"com.example.foo": "build", "com.example.bar": "service"}, c.Targets[0].Labels)
+}
+
+func TestComposeSecretsRequired(t *testing.T) {
+	secretf, err := os.CreateTemp("", "secret")
+	require.NoError(t, err)
+	defer os.Remove(secretf.Name())
+
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - source: found
+          x-required: true
+        - source: optional
+          x-required: false
+        - unchecked
+secrets:
+  found:
+    file: ` + secretf.Name() + `
+  optional:
+    environment: BAKE_TEST_UNSET_SECRET
+  unchecked:
+    environment: BAKE_TEST_UNSET_SECRET
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"id=found,src=" + secretf.Name(),
+		"id=unchecked,env=BAKE_TEST_UNSET_SECRET",
+	}, c.Targets[0].Secrets)
+
+	dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - source: missing
+          x-required: true
+secrets:
+  missing:
+    file: /nonexistent/secret
+`)
+
+	_, err = ParseCompose(dt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "source for required secret missing not found")
+}
+
+func TestComposeAbsContext(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: ./app
+      additional_contexts:
+        assets: ./assets
+        base: docker-image://alpine
+        dep: target:remote
+  remote:
+    build:
+      context: https://github.com/docker/buildx.git
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	sort.Slice(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+	require.Equal(t, "./app", *c.Targets[0].Context)
+	require.Equal(t, "./assets", c.Targets[0].Contexts["assets"])
+
+	wd := t.TempDir()
+	c, err = ParseComposeWithOpt(dt, ComposeOpt{AbsContext: true, WorkingDir: wd})
+	require.NoError(t, err)
+	sort.Slice(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+	require.Equal(t, filepath.Join(wd, "app"), *c.Targets[0].Context)
+	require.Equal(t, map[string]string{
+		"assets": filepath.Join(wd, "assets"),
+		"base":   "docker-image://alpine",
+		"dep":    "target:remote",
+	}, c.Targets[0].Contexts)
+	require.Equal(t, "https://github.com/docker/buildx.git", *c.Targets[1].Context)
+}
+
+func TestComposeExtPlatformsCommaSeparated(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      x-bake:
+        platforms: "linux/amd64, linux/arm64"
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64"}, c.Targets[0].Platforms)
+}
+
+func TestComposeSecretsExternal(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - token
+        - aws
+        - source: npm
+          target: npmrc
+secrets:
+  token:
+    external: true
+  aws:
+    file: /root/.aws/credentials
+  npm:
+    external: true
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"id=token",
+		"id=aws,src=/root/.aws/credentials",
+		"id=npm",
+	}, c.Targets[0].Secrets)
+}
+
+func TestComposeExtOutputList(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      x-bake:
+        output:
+          - type=docker
+          - type=registry
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=docker", "type=registry"}, c.Targets[0].Outputs)
+}
+
+func TestComposeSecretsTargetCollision(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - source: token
+          target: creds
+        - source: aws
+          target: /run/secrets/creds
+secrets:
+  token:
+    environment: ENV_TOKEN
+  aws:
+    file: /root/.aws/credentials
+`)
+
+	_, err := ParseCompose(dt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "secrets token and aws of service app are both mounted at /run/secrets/creds")
+
+	dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - source: token
+          target: token
+        - aws
+secrets:
+  token:
+    environment: ENV_TOKEN
+  aws:
+    file: /root/.aws/credentials
+`)
+
+	_, err = ParseCompose(dt)
+	require.NoError(t, err)
+}
+
+type fakeResolver map[string]string
+
+func (r fakeResolver) Resolve(key string) (string, error) {
+	v, ok := r[key]
+	if !ok {
+		return "", errors.Errorf("unknown key %s", key)
+	}
+	return v, nil
+}
+
+func TestComposeArgsResolver(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      args:
+        BUILD_NUMBER: ${resolve:build-number}
+        VERSION: v${resolve:version}-${ZZZ_SUFFIX}
+        ESCAPED: $${resolve:build-number}
+`)
+
+	os.Setenv("ZZZ_SUFFIX", "rc")
+	defer os.Unsetenv("ZZZ_SUFFIX")
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"BUILD_NUMBER": "",
+		"VERSION":      "v-rc",
+		"ESCAPED":      "${resolve:build-number}",
+	}, c.Targets[0].Args)
+
+	c, err = ParseComposeWithOpt(dt, ComposeOpt{Resolver: fakeResolver{
+		"build-number": "42",
+		"version":      "1.$2",
+	}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"BUILD_NUMBER": "42",
+		"VERSION":      "v1.$2-rc",
+		"ESCAPED":      "${resolve:build-number}",
+	}, c.Targets[0].Args)
+
+	_, err = ParseComposeWithOpt(dt, ComposeOpt{Resolver: fakeResolver{"version": "1"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to resolve build-number: unknown key build-number")
+}
+
+func TestParseComposeLenient(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+  bad:
+    build:
+      context: .
+      x-bake:
+        unknown: true
+  db:
+    labels:
+      - "foo"
+`)
+
+	_, err := ParseCompose(dt)
+	require.Error(t, err)
+
+	c, errs, err := ParseComposeLenient(dt, ComposeOpt{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, "app", c.Targets[0].Name)
+	require.Equal(t, []string{"app"}, c.Groups[0].Targets)
+	require.Equal(t, 2, len(errs))
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	sort.Strings(msgs)
+	require.Contains(t, msgs[0], "service db has neither an image nor a build context specified")
+	require.Contains(t, msgs[1], "unkwown unknown field for x-bake")
+}
+
+func TestComposeTagsDigest(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      tags:
+        - docker.io/user/app:v1
+        - docker.io/user/app@sha256:8d8d85e39ef8b8e28e6c5fe3d2b5e5ec9b9b7d3c0ed3e2b6d2a8d4d6b2f1e3a4
+        - docker.io/user/app:v1@sha256:8d8d85e39ef8b8e28e6c5fe3d2b5e5ec9b9b7d3c0ed3e2b6d2a8d4d6b2f1e3a4
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"docker.io/user/app:v1",
+		"docker.io/user/app@sha256:8d8d85e39ef8b8e28e6c5fe3d2b5e5ec9b9b7d3c0ed3e2b6d2a8d4d6b2f1e3a4",
+		"docker.io/user/app:v1@sha256:8d8d85e39ef8b8e28e6c5fe3d2b5e5ec9b9b7d3c0ed3e2b6d2a8d4d6b2f1e3a4",
+	}, c.Targets[0].Tags)
+
+	dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      tags:
+        - docker.io/user/app@sha256:invalid
+`)
+
+	_, err = ParseCompose(dt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid tag "docker.io/user/app@sha256:invalid" for service app`)
+}
+
+func TestEnvMapForm(t *testing.T) {
+	var dt = []byte(`
+services:
+  list:
+    build:
+      context: .
+      args:
+        CT_ECR: foo
+        NODE_ENV:
+        EMPTY:
+    environment:
+      - NODE_ENV=test
+      - EMPTY=
+  map:
+    build:
+      context: .
+      args:
+        CT_ECR: foo
+        NODE_ENV:
+        EMPTY:
+    environment:
+      NODE_ENV: test
+      EMPTY: ""
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	for _, tgt := range c.Targets {
+		require.Equal(t, map[string]string{"CT_ECR": "foo", "NODE_ENV": "test", "EMPTY": ""}, tgt.Args, tgt.Name)
+	}
+}
+
+func TestComposeSecretEnvUnset(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - token
+secrets:
+  token:
+    environment: BAKE_TEST_UNSET_TOKEN
+`)
+
+	os.Unsetenv("BAKE_TEST_UNSET_TOKEN")
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, []string{"id=token,env=BAKE_TEST_UNSET_TOKEN"}, c.Targets[0].Secrets)
+
+	_, err = ParseComposeWithOpt(dt, ComposeOpt{StrictSecretEnv: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "environment variable BAKE_TEST_UNSET_TOKEN for secret token")
+
+	os.Setenv("BAKE_TEST_UNSET_TOKEN", "secret")
+	defer os.Unsetenv("BAKE_TEST_UNSET_TOKEN")
+
+	c, err = ParseComposeWithOpt(dt, ComposeOpt{StrictSecretEnv: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"id=token,env=BAKE_TEST_UNSET_TOKEN"}, c.Targets[0].Secrets)
+}
+
+func TestComposeArgsDefault(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      args:
+        FROM_ARGS: args
+        FROM_ENV:
+        UNSET:
+      x-bake:
+        args-default:
+          FROM_ARGS: default
+          FROM_ENV: default
+          UNSET: default
+          ONLY_DEFAULT: default
+          OVERRIDDEN: default
+`)
+
+	os.Setenv("FROM_ENV", "env")
+	defer os.Unsetenv("FROM_ENV")
+	os.Unsetenv("UNSET")
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, map[string]string{
+		"FROM_ARGS":    "args",
+		"FROM_ENV":     "env",
+		"UNSET":        "default",
+		"ONLY_DEFAULT": "default",
+		"OVERRIDDEN":   "default",
+	}, c.Targets[0].Args)
+
+	tgt, err := c.ResolveTarget("app", map[string]map[string]Override{
+		"app": {"args.OVERRIDDEN": {Value: "override"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "override", tgt.Args["OVERRIDDEN"])
+	require.Equal(t, "default", tgt.Args["ONLY_DEFAULT"])
+}
+
+func TestComposeArgsReplace(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      args:
+        FIRST: ${BAKE_TEST_REF/o/0}
+        ALL: ${BAKE_TEST_REF//o/0}
+        REMOVE: ${BAKE_TEST_REF/feature}
+        UNSET: ${BAKE_TEST_UNSET/a/b}
+        ESCAPED: $${BAKE_TEST_REF/a/b}
+`)
+
+	os.Setenv("BAKE_TEST_REF", "feature/foo/bar")
+	defer os.Unsetenv("BAKE_TEST_REF")
+	os.Unsetenv("BAKE_TEST_UNSET")
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, map[string]string{
+		"FIRST":   "feature/f0o/bar",
+		"ALL":     "feature/f00/bar",
+		"REMOVE":  "/foo/bar",
+		"UNSET":   "",
+		"ESCAPED": "${BAKE_TEST_REF/a/b}",
+	}, c.Targets[0].Args)
+}
+
+func TestComposeSecretFileArgs(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("s3cr3t\n"), 0600))
+
+	defer func(d string) { composeSecretsDir = d }(composeSecretsDir)
+	composeSecretsDir = dir
+
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      args:
+        TOKEN: ${secretfile:token}
+        HEADER: "Bearer ${secretfile:token}"
+        ESCAPED: $${secretfile:token}
+`)
+
+	c, err := ParseComposeWithOpt(dt, ComposeOpt{SecretFiles: true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"TOKEN":   "s3cr3t",
+		"HEADER":  "Bearer s3cr3t",
+		"ESCAPED": "${secretfile:token}",
+	}, c.Targets[0].Args)
+
+	// references are only supported when enabled
+	_, err = ParseCompose(dt)
+	require.Error(t, err)
+
+	for _, name := range []string{"missing", "../outside", ".."} {
+		_, err = ParseComposeWithOpt([]byte(`
+services:
+  app:
+    build:
+      context: .
+      args:
+        TOKEN: ${secretfile:`+name+`}
+`), ComposeOpt{SecretFiles: true})
+		require.Error(t, err, name)
+	}
+}
+
+func TestComposeContextGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"api", "worker"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "services", d), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "services", "README.md"), []byte("not a context"), 0644))
+
+	var dt = []byte(`
+services:
+  svc:
+    build:
+      context: .
+      args:
+        FOO: bar
+      x-bake:
+        context-glob: services/*
+`)
+
+	c, err := ParseComposeWithOpt(dt, ComposeOpt{WorkingDir: dir})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, []string{"api", "worker"}, c.Groups[0].Targets)
+
+	require.Equal(t, "api", c.Targets[0].Name)
+	require.Equal(t, filepath.Join(dir, "services", "api"), *c.Targets[0].Context)
+	require.Equal(t, map[string]string{"FOO": "bar"}, c.Targets[0].Args)
+	require.Equal(t, "worker", c.Targets[1].Name)
+	require.Equal(t, filepath.Join(dir, "services", "worker"), *c.Targets[1].Context)
+
+	c.Targets[0].Args["FOO"] = "baz"
+	require.Equal(t, "bar", c.Targets[1].Args["FOO"])
+
+	// overriding a generated target leaves its siblings unchanged
+	dt = []byte(`
+services:
+  svc:
+    build:
+      context: .
+      target: release
+      cache_from:
+        - user/cache
+      secrets:
+        - token
+      x-bake:
+        context-glob: services/*
+        platforms: linux/amd64
+secrets:
+  token:
+    file: ./token
+`)
+	c, err = ParseComposeWithOpt(dt, ComposeOpt{WorkingDir: dir})
+	require.NoError(t, err)
+	*c.Targets[0].Target = "debug"
+	c.Targets[0].CacheFrom[0] = "user/api-cache"
+	c.Targets[0].Platforms[0] = "linux/arm64"
+	require.Equal(t, "release", *c.Targets[1].Target)
+	require.Equal(t, []string{"user/cache"}, c.Targets[1].CacheFrom)
+	require.Equal(t, []string{"linux/amd64"}, c.Targets[1].Platforms)
+
+	m, _, err := ReadTargets(context.TODO(), []File{
+		{Name: filepath.Join(dir, "compose.yml"), Data: dt},
+		{Name: "docker-bake.hcl", Data: []byte(`
+target "api" {
+  target = "debug"
+  cache-from = ["user/api-cache"]
+  secret = ["id=extra,src=./extra"]
+  platforms = ["linux/arm64"]
+}`)},
+	}, []string{"api", "worker"}, []string{"api.output=type=docker"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "debug", *m["api"].Target)
+	require.Equal(t, []string{"linux/arm64"}, m["api"].Platforms)
+	require.Equal(t, []string{"type=docker"}, m["api"].Outputs)
+	require.Equal(t, "release", *m["worker"].Target)
+	require.Equal(t, []string{"user/cache"}, m["worker"].CacheFrom)
+	require.Equal(t, []string{"id=token,src=./token"}, m["worker"].Secrets)
+	require.Equal(t, []string{"linux/amd64"}, m["worker"].Platforms)
+	require.Nil(t, m["worker"].Outputs)
+
+	_, err = ParseComposeWithOpt([]byte(`
+services:
+  svc:
+    build:
+      context: .
+      x-bake:
+        context-glob: missing/*
+`), ComposeOpt{WorkingDir: dir})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match any directory")
+}
+
+func TestComposeSecretIDs(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - token
+      x-bake:
+        secret:
+          - id=npm,src=.npmrc
+secrets:
+  token:
+    environment: ENV_TOKEN
+`)
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id=token,env=ENV_TOKEN", "id=npm,src=.npmrc"}, c.Targets[0].Secrets)
+
+	dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      x-bake:
+        secret:
+          - src=.npmrc
+`)
+	_, err = ParseCompose(dt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target app: secret src=.npmrc has no id")
+
+	dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      x-bake:
+        secret:
+          - id=token,src=token.txt
+          - id=token,env=TOKEN
+`)
+	_, err = ParseCompose(dt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target app: duplicate secret id token")
+}
+
+func TestComposeSecretSource(t *testing.T) {
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - token
+secrets:
+  token:
+    source: ./token.txt
+`)
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id=token,src=./token.txt"}, c.Targets[0].Secrets)
+
+	dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - token
+secrets:
+  token:
+    file: ./token.txt
+    source: ./other.txt
+`)
+	_, err = ParseCompose(dt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "compose file invalid: secret token sets both file and source")
+}
+
+func TestComposeSecretPrecedence(t *testing.T) {
+	// x-bake secrets override build secrets with the same id
+	var dt = []byte(`
+services:
+  app:
+    build:
+      context: .
+      secrets:
+        - token
+        - aws
+      x-bake:
+        secret:
+          - id=token,src=token.txt
+          - id=npm,src=.npmrc
+secrets:
+  token:
+    environment: ENV_TOKEN
+  aws:
+    file: /root/.aws/credentials
+`)
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"id=aws,src=/root/.aws/credentials",
+		"id=token,src=token.txt",
+		"id=npm,src=.npmrc",
+	}, c.Targets[0].Secrets)
+}
+
+func TestComposeArgsOrder(t *testing.T) {
+	var dt = []byte(`
+services:
+  map:
+    build:
+      context: .
+      args:
+        ZULU: z
+        ALPHA: a
+        MIKE: m
+      x-bake:
+        args-default:
+          DEFAULT_B: b
+          DEFAULT_A: a
+  list:
+    build:
+      context: .
+      args:
+        - ZULU=z
+        - ALPHA=a
+        - UNSET
+        - MIKE=m
+`)
+
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	sort.Slice(c.Targets, func(i, j int) bool {
+		return c.Targets[i].Name < c.Targets[j].Name
+	})
+
+	require.Equal(t, "list", c.Targets[0].Name)
+	require.Equal(t, []string{"ZULU", "ALPHA", "MIKE"}, c.Targets[0].ArgsOrder)
+	require.Equal(t, "map", c.Targets[1].Name)
+	require.Equal(t, []string{"ZULU", "ALPHA", "MIKE", "DEFAULT_A", "DEFAULT_B"}, c.Targets[1].ArgsOrder)
+}
+
+func TestComposeInclude(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "db", "cache"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db", "compose.yml"), []byte(`
+include:
+  - cache/compose.yml
+x-build: &build
+  dockerfile: Dockerfile.db
+services:
+  db:
+    build:
+      <<: *build
+      args:
+        VERSION: "15"
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db", "cache", "compose.yml"), []byte(`
+services:
+  cache:
+    build: ./app
+`), 0644))
+
+	var dt = []byte(`
+include:
+  - path: db/compose.yml
+services:
+  webapp:
+    build: .
+`)
+
+	c, err := ParseComposeWithOpt(dt, ComposeOpt{WorkingDir: dir})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(c.Targets))
+	require.Equal(t, []string{"cache", "db", "webapp"}, c.Groups[0].Targets)
+	require.Equal(t, "cache", c.Targets[0].Name)
+	require.Equal(t, filepath.Join("db", "cache", "app"), *c.Targets[0].Context)
+	require.Equal(t, "db", c.Targets[1].Name)
+	require.Equal(t, "db", *c.Targets[1].Context)
+	require.Equal(t, "Dockerfile.db", *c.Targets[1].Dockerfile)
+	require.Equal(t, map[string]string{"VERSION": "15"}, c.Targets[1].Args)
+	require.Equal(t, "webapp", c.Targets[2].Name)
+	require.Equal(t, ".", *c.Targets[2].Context)
+
+	_, err = ParseComposeWithOpt([]byte(`
+include:
+  - db/compose.yml
+services:
+  db:
+    build: .
+`), ComposeOpt{WorkingDir: dir})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "service db of included file db/compose.yml conflicts with the including file")
+}
+
+func TestComposeIncludeReadTargets(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	require.NoError(t, os.MkdirAll("sub", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("sub", "compose.yml"), []byte(`
+include:
+  - other.yml
+services:
+  webapp:
+    build: .
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join("sub", "other.yml"), []byte(`
+services:
+  db:
+    build: ./db
+`), 0644))
+
+	files, err := ReadLocalFiles([]string{"sub/compose.yml"})
+	require.NoError(t, err)
+	m, g, err := ReadTargets(context.TODO(), files, []string{"default"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"db", "webapp"}, g[0].Targets)
+	require.Equal(t, "./db", *m["db"].Context)
+	require.Equal(t, ".", *m["webapp"].Context)
+}
+
+func TestComposeTagsServiceName(t *testing.T) {
+	var dt = []byte(`
+x-build: &build
+  context: .
+  tags:
+    - registry/${service}:latest
+services:
+  db:
+    build:
+      <<: *build
+  webapp:
+    build:
+      context: .
+      tags:
+        - registry/$target:${VERSION}
+`)
+
+	t.Setenv("VERSION", "1.0")
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, []string{"registry/db:latest"}, c.Targets[0].Tags)
+	require.Equal(t, []string{"registry/webapp:1.0"}, c.Targets[1].Tags)
+
+	t.Setenv("service", "app")
+	c, err = ParseCompose(dt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"registry/app:latest"}, c.Targets[0].Tags)
+	require.Equal(t, []string{"registry/webapp:1.0"}, c.Targets[1].Tags)
+}
@@ -0,0 +1,308 @@
+package bake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var shellSafePattern = regexp.MustCompile(`^[a-zA-Z0-9_./:=,@%+-]+$`)
+
+type githubMatrixEntry struct {
+	Target   string `json:"target"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// GitHubMatrix returns a GitHub Actions matrix in JSON format with an entry
+// for each target and platform combination. Targets without platforms get a
+// single entry with no platform set.
+func GitHubMatrix(m map[string]*Target) ([]byte, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	include := []githubMatrixEntry{}
+	for _, name := range names {
+		t := m[name]
+		if len(t.Platforms) == 0 {
+			include = append(include, githubMatrixEntry{Target: name})
+			continue
+		}
+		for _, p := range t.Platforms {
+			include = append(include, githubMatrixEntry{Target: name, Platform: p})
+		}
+	}
+
+	return json.Marshal(struct {
+		Include []githubMatrixEntry `json:"include"`
+	}{
+		Include: include,
+	})
+}
+
+// Makefile returns a Makefile with a rule invoking bake for each target and an
+// aggregate rule for each group depending on the rules of its targets. The
+// default group, if any, is the default goal. The bake command can be changed
+// with the BAKE make variable.
+func (c Config) Makefile() []byte {
+	groups := make([]*Group, 0, len(c.Groups))
+	for _, g := range c.Groups {
+		groups = append(groups, g)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[j].Name == "default" {
+			return false
+		}
+		return groups[i].Name == "default" || groups[i].Name < groups[j].Name
+	})
+
+	isGroup := map[string]struct{}{}
+	names := make([]string, 0, len(c.Groups)+len(c.Targets))
+	for _, g := range groups {
+		isGroup[g.Name] = struct{}{}
+		names = append(names, g.Name)
+	}
+	targets := make([]string, 0, len(c.Targets))
+	for _, t := range c.Targets {
+		if _, ok := isGroup[t.Name]; !ok {
+			targets = append(targets, t.Name)
+		}
+	}
+	sort.Strings(targets)
+	names = append(names, targets...)
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Code generated by docker buildx bake. DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "BAKE ?= docker buildx bake")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, ".PHONY: %s\n", strings.Join(names, " "))
+	for _, g := range groups {
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "%s: %s\n", g.Name, strings.Join(g.Targets, " "))
+	}
+	for _, name := range targets {
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "%s:\n\t$(BAKE) %s\n", name, name)
+	}
+	return b.Bytes()
+}
+
+// BuildCommands returns the docker buildx build command line equivalent to
+// each resolved target, in the order the targets are defined. Build args with
+// a name matching SensitiveArgsPattern are masked. Secrets are printed as is
+// as they only reference their source. Inline dockerfiles and annotations have
+// no command line equivalent and are omitted. The dockerfile of a local context
+// is printed relative to the working directory, as build expects it.
+func (c *Config) BuildCommands() ([]string, error) {
+	cmds := make([]string, 0, len(c.Targets))
+	for _, t := range c.Targets {
+		rt, err := c.ResolveTarget(t.Name, nil)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, buildCommand(rt))
+	}
+	return cmds, nil
+}
+
+func buildCommand(t *Target) string {
+	args := []string{"docker", "buildx"}
+	if t.Builder != nil {
+		args = append(args, "--builder", shellQuote(*t.Builder))
+	}
+	args = append(args, "build")
+	flag := func(name string, values ...string) {
+		for _, v := range values {
+			args = append(args, "--"+name, shellQuote(v))
+		}
+	}
+	flagMap := func(name string, m map[string]string, mask bool) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := m[k]
+			if mask && SensitiveArgsPattern.MatchString(k) {
+				v = maskedValue
+			}
+			flag(name, k+"="+v)
+		}
+	}
+
+	contextPath := "."
+	if t.Context != nil {
+		contextPath = *t.Context
+	}
+	if t.Dockerfile != nil {
+		// build resolves the dockerfile from the working directory while bake
+		// resolves it within a local context
+		dockerfilePath := *t.Dockerfile
+		if dockerfilePath != "-" && !isRemoteResource(contextPath) && !path.IsAbs(dockerfilePath) {
+			dockerfilePath = path.Join(contextPath, dockerfilePath)
+		}
+		flag("file", dockerfilePath)
+	}
+	if t.Target != nil {
+		flag("target", *t.Target)
+	}
+	flagMap("build-arg", t.Args, true)
+	flagMap("label", t.Labels, false)
+	flagMap("build-context", t.Contexts, false)
+	flag("tag", t.Tags...)
+	if len(t.Platforms) > 0 {
+		flag("platform", strings.Join(t.Platforms, ","))
+	}
+	flag("cache-from", t.CacheFrom...)
+	flag("cache-to", t.CacheTo...)
+	flag("secret", t.Secrets...)
+	flag("ssh", t.SSH...)
+	flag("output", t.Outputs...)
+	if t.NetworkMode != nil {
+		flag("network", *t.NetworkMode)
+	}
+	flag("no-cache-filter", t.NoCacheFilter...)
+	flag("add-host", t.ExtraHosts...)
+	if t.ShmSize != nil {
+		flag("shm-size", *t.ShmSize)
+	}
+	flag("ulimit", t.Ulimits...)
+	flag("allow", t.Entitlements...)
+	if t.Pull != nil && *t.Pull {
+		args = append(args, "--pull")
+	}
+	if t.NoCache != nil && *t.NoCache {
+		args = append(args, "--no-cache")
+	}
+
+	args = append(args, shellQuote(contextPath))
+	return strings.Join(args, " ")
+}
+
+// FrontendOpts returns the BuildKit frontend options equivalent to the
+// resolved target, as passed by build to the dockerfile frontend. Only the
+// dockerfile base name is set since the dockerfile itself is sent as a local
+// source. Named contexts are only included if they reference a remote source
+// or an image, as local directories and other targets are only resolved by
+// build.
+func (t *Target) FrontendOpts() map[string]string {
+	opts := map[string]string{}
+
+	filename := "Dockerfile"
+	if t.Dockerfile != nil && *t.Dockerfile != "" {
+		filename = path.Base(*t.Dockerfile)
+	}
+	opts["filename"] = filename
+
+	if t.Target != nil && *t.Target != "" {
+		opts["target"] = *t.Target
+	}
+	for k, v := range t.Args {
+		opts["build-arg:"+k] = v
+	}
+	for k, v := range t.Labels {
+		opts["label:"+k] = v
+	}
+	if len(t.Platforms) > 0 {
+		opts["platform"] = strings.Join(t.Platforms, ",")
+	}
+	if len(t.NoCacheFilter) > 0 {
+		opts["no-cache"] = strings.Join(t.NoCacheFilter, ",")
+	}
+	if t.NoCache != nil && *t.NoCache {
+		opts["no-cache"] = ""
+	}
+	if t.Pull != nil && *t.Pull {
+		opts["image-resolve-mode"] = "pull"
+	}
+	if t.NetworkMode != nil && (*t.NetworkMode == "host" || *t.NetworkMode == "none") {
+		opts["force-network-mode"] = *t.NetworkMode
+	}
+	if fn, _ := t.callFunc(); fn != "" {
+		opts["requestid"] = "frontend." + fn
+	}
+	for k, v := range t.Contexts {
+		if isRemoteResource(v) || strings.HasPrefix(v, "docker-image://") {
+			opts["context:"+k] = v
+		}
+	}
+	return opts
+}
+
+// shellQuote quotes s for a POSIX shell if needed.
+func shellQuote(s string) string {
+	if shellSafePattern.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// GraphDOT returns a Graphviz DOT graph of the groups and targets, with edges
+// from groups to their members and from targets to the targets they inherit
+// from or use as named context.
+func (c *Config) GraphDOT() string {
+	groups := make([]*Group, len(c.Groups))
+	copy(groups, c.Groups)
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	targets := make([]*Target, len(c.Targets))
+	copy(targets, c.Targets)
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Name < targets[j].Name
+	})
+
+	isGroup := map[string]struct{}{}
+	for _, g := range groups {
+		isGroup[g.Name] = struct{}{}
+	}
+	groupNode := func(name string) string {
+		return fmt.Sprintf("%q", "group."+name)
+	}
+	targetNode := func(name string) string {
+		return fmt.Sprintf("%q", "target."+name)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "digraph bake {")
+	for _, g := range groups {
+		fmt.Fprintf(&b, "\t%s [label=%q, shape=folder];\n", groupNode(g.Name), g.Name)
+	}
+	for _, t := range targets {
+		fmt.Fprintf(&b, "\t%s [label=%q, shape=box];\n", targetNode(t.Name), t.Name)
+	}
+	for _, g := range groups {
+		for _, name := range g.Targets {
+			if _, ok := isGroup[name]; ok {
+				fmt.Fprintf(&b, "\t%s -> %s;\n", groupNode(g.Name), groupNode(name))
+			} else {
+				fmt.Fprintf(&b, "\t%s -> %s;\n", groupNode(g.Name), targetNode(name))
+			}
+		}
+	}
+	for _, t := range targets {
+		for _, name := range t.Inherits {
+			fmt.Fprintf(&b, "\t%s -> %s [label=\"inherits\"];\n", targetNode(t.Name), targetNode(name))
+		}
+		keys := make([]string, 0, len(t.Contexts))
+		for k := range t.Contexts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if name := strings.TrimPrefix(t.Contexts[k], "target:"); name != t.Contexts[k] {
+				fmt.Fprintf(&b, "\t%s -> %s [label=%q];\n", targetNode(t.Name), targetNode(name), "context:"+k)
+			}
+		}
+	}
+	fmt.Fprintln(&b, "}")
+	return b.String()
+}
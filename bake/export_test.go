@@ -0,0 +1,222 @@
+package bake
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubMatrix(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+group "default" {
+  targets = ["webapp", "db", "docs"]
+}
+
+target "webapp" {
+  platforms = ["linux/amd64", "linux/arm64"]
+}
+
+target "db" {
+  platforms = ["linux/amd64"]
+}
+
+target "docs" {
+}`),
+	}
+
+	m, _, err := ReadTargets(context.TODO(), []File{fp}, []string{"default"}, nil, nil)
+	require.NoError(t, err)
+
+	dt, err := GitHubMatrix(m)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+  "include": [
+    {"target": "db", "platform": "linux/amd64"},
+    {"target": "docs"},
+    {"target": "webapp", "platform": "linux/amd64"},
+    {"target": "webapp", "platform": "linux/arm64"}
+  ]
+}`, string(dt))
+}
+
+func TestMakefile(t *testing.T) {
+	c, err := ParseFile([]byte(`
+group "release" {
+  targets = ["webapp", "db"]
+}
+
+group "default" {
+  targets = ["webapp"]
+}
+
+target "webapp" {
+  dockerfile = "webapp.Dockerfile"
+}
+
+target "db" {
+  dockerfile = "db.Dockerfile"
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, `# Code generated by docker buildx bake. DO NOT EDIT.
+
+BAKE ?= docker buildx bake
+
+.PHONY: default release db webapp
+
+default: webapp
+
+release: webapp db
+
+db:
+	$(BAKE) db
+
+webapp:
+	$(BAKE) webapp
+`, string(c.Makefile()))
+}
+
+func TestBuildCommands(t *testing.T) {
+	c, err := ParseFile([]byte(`
+target "base" {
+  dockerfile = "app.Dockerfile"
+  args = {
+    GITHUB_TOKEN = "ghp_secret"
+  }
+}
+
+target "app" {
+  inherits = ["base"]
+  context = "./app"
+  target = "release"
+  args = {
+    VERSION = "1.0"
+  }
+  labels = {
+    "org.opencontainers.image.title" = "my app"
+  }
+  tags = ["user/app:latest"]
+  platforms = ["linux/amd64", "linux/arm64"]
+  cache-from = ["type=registry,ref=user/app:cache"]
+  secret = ["id=npm,src=.npmrc"]
+  push = true
+  no-cache = true
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	cmds, err := c.BuildCommands()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(cmds))
+	require.Equal(t, "docker buildx build --file app.Dockerfile --build-arg 'GITHUB_TOKEN=*****' .", cmds[0])
+	require.Equal(t, "docker buildx build"+
+		" --file app/app.Dockerfile"+
+		" --target release"+
+		" --build-arg 'GITHUB_TOKEN=*****'"+
+		" --build-arg VERSION=1.0"+
+		" --label 'org.opencontainers.image.title=my app'"+
+		" --tag user/app:latest"+
+		" --platform linux/amd64,linux/arm64"+
+		" --cache-from type=registry,ref=user/app:cache"+
+		" --secret id=npm,src=.npmrc"+
+		" --output type=image,push=true"+
+		" --no-cache"+
+		" ./app", cmds[1])
+
+	c, err = ParseFile([]byte(`
+target "app" {
+  inherits = ["missing"]
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	_, err = c.BuildCommands()
+	require.Error(t, err)
+}
+
+func TestFrontendOpts(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+target "base" {
+}
+
+target "app" {
+  context = "./app"
+  dockerfile = "build/app.Dockerfile"
+  target = "release"
+  args = {
+    VERSION = "1.0"
+  }
+  contexts = {
+    alpine = "docker-image://alpine:3.16"
+    src = "./src"
+    base = "target:base"
+  }
+  platforms = ["linux/amd64", "linux/arm64"]
+  pull = true
+}`),
+	}
+
+	m, _, err := ReadTargets(context.TODO(), []File{fp}, []string{"app"}, nil, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{
+		"filename":           "app.Dockerfile",
+		"target":             "release",
+		"build-arg:VERSION":  "1.0",
+		"platform":           "linux/amd64,linux/arm64",
+		"image-resolve-mode": "pull",
+		"context:alpine":     "docker-image://alpine:3.16",
+	}, m["app"].FrontendOpts())
+
+	require.Equal(t, map[string]string{"filename": "Dockerfile"}, (&Target{}).FrontendOpts())
+}
+
+func TestGraphDOT(t *testing.T) {
+	c, err := ParseFile([]byte(`
+group "default" {
+  targets = ["app", "all"]
+}
+
+group "all" {
+  targets = ["app", "docs"]
+}
+
+target "base" {
+  dockerfile = "base.Dockerfile"
+}
+
+target "deps" {
+  target = "deps"
+}
+
+target "app" {
+  inherits = ["base"]
+  contexts = {
+    deps = "target:deps"
+    src = "./src"
+  }
+}
+
+target "docs" {
+}`), "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, `digraph bake {
+	"group.all" [label="all", shape=folder];
+	"group.default" [label="default", shape=folder];
+	"target.app" [label="app", shape=box];
+	"target.base" [label="base", shape=box];
+	"target.deps" [label="deps", shape=box];
+	"target.docs" [label="docs", shape=box];
+	"group.all" -> "target.app";
+	"group.all" -> "target.docs";
+	"group.default" -> "target.app";
+	"group.default" -> "group.all";
+	"target.app" -> "target.base" [label="inherits"];
+	"target.app" -> "target.deps" [label="context:deps"];
+}
+`, c.GraphDOT())
+}
@@ -0,0 +1,80 @@
+package bake
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitDirtyDetector reports whether a local directory is part of a git working
+// tree with uncommitted changes.
+type GitDirtyDetector interface {
+	IsDirty(dir string) (bool, error)
+}
+
+// GitDirtyDetectorFunc adapts a function to the GitDirtyDetector interface.
+type GitDirtyDetectorFunc func(dir string) (bool, error)
+
+func (f GitDirtyDetectorFunc) IsDirty(dir string) (bool, error) {
+	return f(dir)
+}
+
+// gitCLIDirty uses the git command to check for uncommitted changes under
+// dir. Directories outside of a git working tree are never dirty.
+func gitCLIDirty(dir string) (bool, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return false, nil
+	}
+	if err := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		return false, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", "-C", dir, "status", "--porcelain", "--", ".")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return false, errors.Wrapf(err, "failed to get git status of %s: %s", dir, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Len() > 0, nil
+}
+
+// DirtyContextWarnings returns a warning for each pushing target whose local
+// build context contains uncommitted changes, as the pushed image may include
+// them. If d is nil, the git command is used to detect changes.
+func DirtyContextWarnings(m map[string]*Target, d GitDirtyDetector) ([]string, error) {
+	if d == nil {
+		d = GitDirtyDetectorFunc(gitCLIDirty)
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		t := m[name]
+		if !t.WillPush() {
+			continue
+		}
+		contextPath := "."
+		if t.Context != nil {
+			contextPath = strings.TrimPrefix(*t.Context, "cwd://")
+		}
+		if contextPath == "-" || IsRemoteURL(contextPath) {
+			continue
+		}
+		dirty, err := d.IsDirty(contextPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", name)
+		}
+		if dirty {
+			warnings = append(warnings, fmt.Sprintf("target %s: git working tree of context %s has uncommitted changes that may be included in the pushed image", name, contextPath))
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,40 @@
+package bake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirtyContextWarnings(t *testing.T) {
+	m := map[string]*Target{
+		"app": {
+			Context: stringPtr("app"),
+			Outputs: []string{"type=registry"},
+		},
+		"clean": {
+			Context: stringPtr("clean"),
+			Outputs: []string{"type=image,push=true"},
+		},
+		"local": {
+			Context: stringPtr("app"),
+			Outputs: []string{"type=docker"},
+		},
+		"remote": {
+			Context: stringPtr("https://github.com/docker/buildx.git"),
+			Outputs: []string{"type=registry"},
+		},
+	}
+
+	var checked []string
+	detector := GitDirtyDetectorFunc(func(dir string) (bool, error) {
+		checked = append(checked, dir)
+		return dir == "app", nil
+	})
+
+	warnings, err := DirtyContextWarnings(m, detector)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "clean"}, checked)
+	require.Equal(t, 1, len(warnings))
+	require.Contains(t, warnings[0], "target app: git working tree of context app has uncommitted changes")
+}
@@ -1,12 +1,17 @@
 package bake
 
 import (
+	"reflect"
 	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/moby/buildkit/solver/errdefs"
 	"github.com/moby/buildkit/solver/pb"
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
 )
 
 func ParseHCLFile(dt []byte, fn string) (*hcl.File, bool, error) {
@@ -36,6 +41,96 @@ func ParseHCLFile(dt []byte, fn string) (*hcl.File, bool, error) {
 	return f, true, nil
 }
 
+// SetHCLTargetAttribute returns the HCL definition dt with the attribute key
+// of target name set to value, preserving the comments and formatting of the
+// rest of the file. If the target is defined multiple times, the last
+// definition is updated as it takes precedence.
+func SetHCLTargetAttribute(dt []byte, fn, name, key string, value cty.Value) ([]byte, error) {
+	f, diags := hclwrite.ParseConfig(dt, fn, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var target *hclwrite.Block
+	for _, b := range f.Body().Blocks() {
+		if b.Type() == "target" && len(b.Labels()) == 1 && b.Labels()[0] == name {
+			target = b
+		}
+	}
+	if target == nil {
+		return nil, errors.Errorf("target %s not found in %s", name, fn)
+	}
+	target.Body().SetAttributeValue(key, value)
+	return f.Bytes(), nil
+}
+
+// SplitFiles returns an HCL definition for each target of the config, named
+// docker-bake.<target>.hcl, and one with the groups named docker-bake.hcl if
+// any. Loading all the files together gives back the config. Fields that can
+// not be set in HCL, like the network mode of compose services, are dropped.
+func (c *Config) SplitFiles() map[string][]byte {
+	files := map[string][]byte{}
+	if len(c.Groups) > 0 {
+		f := hclwrite.NewEmptyFile()
+		for i, g := range c.Groups {
+			if i > 0 {
+				f.Body().AppendNewline()
+			}
+			b := f.Body().AppendNewBlock("group", []string{g.Name})
+			targets := make([]cty.Value, 0, len(g.Targets))
+			for _, t := range g.Targets {
+				targets = append(targets, cty.StringVal(t))
+			}
+			if len(targets) == 0 {
+				b.Body().SetAttributeValue("targets", cty.ListValEmpty(cty.String))
+			} else {
+				b.Body().SetAttributeValue("targets", cty.ListVal(targets))
+			}
+		}
+		files["docker-bake.hcl"] = f.Bytes()
+	}
+	for _, t := range c.Targets {
+		f := hclwrite.NewEmptyFile()
+		writeHCLTarget(f.Body().AppendNewBlock("target", []string{t.Name}).Body(), t)
+		files["docker-bake."+t.Name+".hcl"] = f.Bytes()
+	}
+	return files
+}
+
+// writeHCLTarget sets the non-empty HCL attributes of t on body, in the order
+// of the fields of Target.
+func writeHCLTarget(body *hclwrite.Body, t *Target) {
+	rv := reflect.ValueOf(t).Elem()
+	ty := rv.Type()
+	for i := 0; i < ty.NumField(); i++ {
+		tag := ty.Field(i).Tag.Get("hcl")
+		name := strings.SplitN(tag, ",", 2)[0]
+		if name == "" || name == "-" || strings.HasSuffix(tag, ",label") {
+			continue
+		}
+		fv := rv.Field(i)
+		switch fv.Kind() {
+		case reflect.Ptr:
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		case reflect.Slice, reflect.Map:
+			if fv.Len() == 0 {
+				continue
+			}
+		}
+		vt, err := gocty.ImpliedType(fv.Interface())
+		if err != nil {
+			continue
+		}
+		v, err := gocty.ToCtyValue(fv.Interface(), vt)
+		if err != nil {
+			continue
+		}
+		body.SetAttributeValue(name, v)
+	}
+}
+
 func formatHCLError(err error, files []File) error {
 	if err == nil {
 		return nil
@@ -1,10 +1,12 @@
 package bake
 
 import (
+	"context"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
 )
 
 func TestHCLBasic(t *testing.T) {
@@ -150,6 +152,35 @@ func TestHCLWithFunctions(t *testing.T) {
 	require.Equal(t, "124", c.Targets[0].Args["buildno"])
 }
 
+func TestHCLEnvFileFunction(t *testing.T) {
+	envf, err := os.CreateTemp("", "build.env")
+	require.NoError(t, err)
+	defer os.Remove(envf.Name())
+
+	_, err = envf.WriteString("FOO=bar\n# comment\nBAR=\"baz qux\"\n")
+	require.NoError(t, err)
+
+	dt := []byte(`
+		target "webapp" {
+			args = envfile("` + envf.Name() + `")
+		}
+		`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(c.Targets))
+	require.Equal(t, map[string]string{"FOO": "bar", "BAR": "baz qux"}, c.Targets[0].Args)
+
+	dt = []byte(`
+		target "webapp" {
+			args = envfile("/nonexistent/build.env")
+		}
+		`)
+
+	_, err = ParseFile(dt, "docker-bake.hcl")
+	require.Error(t, err)
+}
+
 func TestHCLWithUserDefinedFunctions(t *testing.T) {
 	dt := []byte(`
 		function "increment" {
@@ -396,6 +427,35 @@ func TestHCLTypedVariables(t *testing.T) {
 	require.Contains(t, err.Error(), "failed to parse IS_FOO as bool")
 }
 
+func TestHCLVariableValidation(t *testing.T) {
+	dt := []byte(`
+		variable "REPLICAS" {
+			default = 3
+			validation {
+				condition = REPLICAS >= 1 && REPLICAS <= 5
+				error_message = "REPLICAS must be between 1 and 5, got ${REPLICAS}."
+			}
+		}
+
+		target "app" {
+			args = {
+				REPLICAS = REPLICAS
+			}
+		}
+		`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+	require.Equal(t, "3", c.Targets[0].Args["REPLICAS"])
+
+	os.Setenv("REPLICAS", "10")
+	defer os.Unsetenv("REPLICAS")
+
+	_, err = ParseFile(dt, "docker-bake.hcl")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "REPLICAS must be between 1 and 5, got 10.")
+}
+
 func TestHCLVariableCycle(t *testing.T) {
 	dt := []byte(`
 		variable "FOO" {
@@ -600,6 +660,48 @@ services:
 	require.Equal(t, "Dockerfile-alternate", *c.Targets[0].Dockerfile)
 }
 
+func TestHCLOverridesCompose(t *testing.T) {
+	dt := []byte(`
+		target "web" {
+			platforms = ["linux/amd64", "linux/arm64"]
+			args = {
+				v2 = "baz"
+			}
+		}
+		`)
+	dt2 := []byte(`
+services:
+  web:
+    build:
+      context: ./web
+      args:
+        v1: "foo"
+        v2: "bar"
+      x-bake:
+        platforms: linux/arm/v7
+  db:
+    build:
+      context: ./db
+`)
+
+	for _, files := range [][]File{
+		{{Data: dt, Name: "docker-bake.hcl"}, {Data: dt2, Name: "docker-compose.yml"}},
+		{{Data: dt2, Name: "docker-compose.yml"}, {Data: dt, Name: "docker-bake.hcl"}},
+	} {
+		c, err := ParseFiles(files, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, 2, len(c.Targets))
+		require.Equal(t, "db", c.Targets[0].Name)
+		require.Equal(t, "./db", *c.Targets[0].Context)
+		require.Nil(t, c.Targets[0].Platforms)
+		require.Equal(t, "web", c.Targets[1].Name)
+		require.Equal(t, "./web", *c.Targets[1].Context)
+		require.Equal(t, []string{"linux/amd64", "linux/arm64"}, c.Targets[1].Platforms)
+		require.Equal(t, map[string]string{"v1": "foo", "v2": "baz"}, c.Targets[1].Args)
+	}
+}
+
 func TestHCLBuiltinVars(t *testing.T) {
 	dt := []byte(`
 		target "app" {
@@ -755,3 +857,372 @@ func TestEmptyVariableJSON(t *testing.T) {
 	_, err := ParseFile(dt, "docker-bake.json")
 	require.NoError(t, err)
 }
+
+func TestHCLTargetReferences(t *testing.T) {
+	dt := []byte(`
+		target "app" {
+			args = {
+				DB_IMAGE = target.db.tags[0]
+			}
+		}
+		target "db" {
+			tags = ["example/db:${VERSION}", "example/db:latest"]
+		}
+		VERSION = "1.0"
+	`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, "app", c.Targets[0].Name)
+	require.Equal(t, map[string]string{"DB_IMAGE": "example/db:1.0"}, c.Targets[0].Args)
+	require.Equal(t, "db", c.Targets[1].Name)
+}
+
+func TestHCLTargetReferencesCycle(t *testing.T) {
+	dt := []byte(`
+		target "app" {
+			tags = [target.db.tags[0]]
+		}
+		target "db" {
+			tags = [target.app.tags[0]]
+		}
+	`)
+
+	_, err := ParseFile(dt, "docker-bake.hcl")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "reference cycle not allowed")
+}
+
+func TestHCLTargetReferencesMissing(t *testing.T) {
+	dt := []byte(`
+		target "app" {
+			args = {
+				DB_IMAGE = target.db.tags[0]
+			}
+		}
+	`)
+
+	_, err := ParseFile(dt, "docker-bake.hcl")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `undefined target "db"`)
+
+	dt = []byte(`
+		target "app" {
+			args = {
+				DB_IMAGE = target.db.tags[0]
+			}
+		}
+		target "db" {
+			dockerfile = "db.Dockerfile"
+		}
+	`)
+
+	_, err = ParseFile(dt, "docker-bake.hcl")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Unsupported attribute")
+}
+
+func TestHCLMatrixTags(t *testing.T) {
+	dt := []byte(`
+		target "app" {
+			name = "app-${regex_replace(matrix.version, "[.]", "-")}"
+			matrix = {
+				version = ["1.0", "2.0"]
+			}
+			args = {
+				VERSION = matrix.version
+			}
+			tags = ["app:${matrix.version}", "app:${matrix.version}-${TAG_SUFFIX}"]
+		}
+		TAG_SUFFIX = "alpine"
+	`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(c.Targets))
+	require.Equal(t, "app-1-0", c.Targets[0].Name)
+	require.Equal(t, []string{"app:1.0", "app:1.0-alpine"}, c.Targets[0].Tags)
+	require.Equal(t, map[string]string{"VERSION": "1.0"}, c.Targets[0].Args)
+	require.Equal(t, "app-2-0", c.Targets[1].Name)
+	require.Equal(t, []string{"app:2.0", "app:2.0-alpine"}, c.Targets[1].Tags)
+	require.Equal(t, map[string]string{"VERSION": "2.0"}, c.Targets[1].Args)
+}
+
+func TestHCLMatrixCombinations(t *testing.T) {
+	dt := []byte(`
+		target "app" {
+			matrix = {
+				tgt = ["web", "api"]
+				base = ["alpine", "debian"]
+			}
+			target = matrix.tgt
+			tags = ["app/${matrix.tgt}:${matrix.base}"]
+		}
+	`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+
+	require.Equal(t, 4, len(c.Targets))
+	require.Equal(t, "app-alpine-web", c.Targets[0].Name)
+	require.Equal(t, "web", *c.Targets[0].Target)
+	require.Equal(t, []string{"app/web:alpine"}, c.Targets[0].Tags)
+	require.Equal(t, "app-alpine-api", c.Targets[1].Name)
+	require.Equal(t, []string{"app/api:alpine"}, c.Targets[1].Tags)
+	require.Equal(t, "app-debian-web", c.Targets[2].Name)
+	require.Equal(t, []string{"app/web:debian"}, c.Targets[2].Tags)
+	require.Equal(t, "app-debian-api", c.Targets[3].Name)
+	require.Equal(t, "api", *c.Targets[3].Target)
+	require.Equal(t, []string{"app/api:debian"}, c.Targets[3].Tags)
+}
+
+func TestHCLMatrixGroup(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+			group "default" {
+				targets = ["app"]
+			}
+			target "app" {
+				name = "app-${matrix.tgt}"
+				matrix = {
+					tgt = ["web", "api"]
+				}
+				target = matrix.tgt
+			}
+		`),
+	}
+	ctx := context.TODO()
+
+	m, g, err := ReadTargets(ctx, []File{fp}, []string{"default"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(m))
+	require.Equal(t, "web", *m["app-web"].Target)
+	require.Equal(t, "api", *m["app-api"].Target)
+	require.Equal(t, []string{"app"}, g[0].Targets)
+
+	m, g, err = ReadTargets(ctx, []File{fp}, []string{"app"}, []string{"app.tags=app:latest"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(m))
+	require.Equal(t, []string{"app:latest"}, m["app-web"].Tags)
+	require.Equal(t, []string{"app:latest"}, m["app-api"].Tags)
+	require.Equal(t, []string{"app-web", "app-api"}, g[0].Targets)
+}
+
+func TestHCLMatrixInvalid(t *testing.T) {
+	dt := []byte(`
+		target "app" {
+			matrix = {
+				version = []
+			}
+		}
+	`)
+
+	_, err := ParseFile(dt, "docker-bake.hcl")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `matrix value "version" must not be empty`)
+}
+
+func TestSetHCLTargetAttribute(t *testing.T) {
+	dt := []byte(`# release configuration
+target "app" {
+  # bumped by the release tooling
+  tags = ["user/app:1.0"] // current version
+  args = {
+    FOO = "bar" # keep
+  }
+}
+
+// database
+target "db" {
+  tags = ["user/db:1.0"]
+}
+`)
+
+	out, err := SetHCLTargetAttribute(dt, "docker-bake.hcl", "app", "tags", cty.ListVal([]cty.Value{cty.StringVal("user/app:2.0")}))
+	require.NoError(t, err)
+	require.Equal(t, `# release configuration
+target "app" {
+  # bumped by the release tooling
+  tags = ["user/app:2.0"] // current version
+  args = {
+    FOO = "bar" # keep
+  }
+}
+
+// database
+target "db" {
+  tags = ["user/db:1.0"]
+}
+`, string(out))
+
+	c, err := ParseFile(out, "docker-bake.hcl")
+	require.NoError(t, err)
+	require.Equal(t, []string{"user/app:2.0"}, c.Targets[0].Tags)
+
+	_, err = SetHCLTargetAttribute(dt, "docker-bake.hcl", "missing", "tags", cty.ListValEmpty(cty.String))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target missing not found")
+}
+
+func TestHCLSharedTagScheme(t *testing.T) {
+	dt := []byte(`
+		variable "VERSION" {
+			default = "1.0"
+		}
+		variable "REGISTRY" {
+			default = "docker.io/user"
+		}
+		function "tags" {
+			params = [name]
+			result = ["${REGISTRY}/${name}:${VERSION}", "${REGISTRY}/${name}:latest"]
+		}
+		target "app" {
+			tags = tags("app")
+		}
+		target "db" {
+			tags = tags("db")
+		}
+		target "docs" {
+			tags = [tags("docs")[0]]
+		}
+	`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(c.Targets))
+	require.Equal(t, []string{"docker.io/user/app:1.0", "docker.io/user/app:latest"}, c.Targets[0].Tags)
+	require.Equal(t, []string{"docker.io/user/db:1.0", "docker.io/user/db:latest"}, c.Targets[1].Tags)
+	require.Equal(t, []string{"docker.io/user/docs:1.0"}, c.Targets[2].Tags)
+
+	os.Setenv("VERSION", "2.0")
+	defer os.Unsetenv("VERSION")
+
+	c, err = ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/user/app:2.0", "docker.io/user/app:latest"}, c.Targets[0].Tags)
+	require.Equal(t, []string{"docker.io/user/db:2.0", "docker.io/user/db:latest"}, c.Targets[1].Tags)
+	require.Equal(t, []string{"docker.io/user/docs:2.0"}, c.Targets[2].Tags)
+}
+
+func TestSplitFiles(t *testing.T) {
+	dt := []byte(`
+services:
+  db:
+    build: ./db
+    image: docker.io/tonistiigi/db
+  webapp:
+    build:
+      context: ./dir
+      dockerfile: Dockerfile-alternate
+      args:
+        buildno: 123
+        message: "hello ${USER:-world}"
+      x-bake:
+        platforms:
+          - linux/amd64
+          - linux/arm64
+        cache-from: type=local,src=path/to/cache
+        no-cache: true
+`)
+	c, err := ParseCompose(dt)
+	require.NoError(t, err)
+
+	files := c.SplitFiles()
+	require.Equal(t, 3, len(files))
+	require.Contains(t, files, "docker-bake.hcl")
+	require.Contains(t, files, "docker-bake.db.hcl")
+	require.Contains(t, files, "docker-bake.webapp.hcl")
+
+	var fs []File
+	for _, n := range []string{"docker-bake.hcl", "docker-bake.db.hcl", "docker-bake.webapp.hcl"} {
+		fs = append(fs, File{Name: n, Data: files[n]})
+	}
+	c2, err := ParseFiles(fs, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, c.Groups, c2.Groups)
+	require.Equal(t, len(c.Targets), len(c2.Targets))
+	for i, t1 := range c.Targets {
+		// not set in HCL
+		t1.NetworkMode = nil
+		t1.ArgsOrder = nil
+		require.Equal(t, t1, c2.Targets[i])
+	}
+}
+
+func TestHCLAnnotationsInherits(t *testing.T) {
+	dt := []byte(`
+target "base" {
+  annotations = [
+    "org.opencontainers.image.vendor=docker",
+    "org.opencontainers.image.title=base",
+  ]
+}
+target "app" {
+  inherits = ["base"]
+  annotations = [
+    "org.opencontainers.image.title=app",
+    "index:org.opencontainers.image.source=https://github.com/docker/buildx",
+  ]
+}
+`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+
+	tgt, err := c.ResolveTarget("app", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"org.opencontainers.image.vendor=docker",
+		"org.opencontainers.image.title=app",
+		"index:org.opencontainers.image.source=https://github.com/docker/buildx",
+	}, tgt.Annotations)
+}
+
+func TestHCLInheritsReset(t *testing.T) {
+	dt := []byte(`
+target "base" {
+  cache-from = ["type=registry,ref=user/base:cache"]
+  cache-to = ["type=inline"]
+  tags = ["user/base"]
+  platforms = ["linux/amd64", "linux/arm64"]
+  secret = ["id=token,env=TOKEN"]
+  ssh = ["default"]
+}
+target "app" {
+  inherits = ["base"]
+  cache-from = ["!reset", "type=local,src=cache"]
+  cache-to = ["!reset"]
+  platforms = ["!reset", "linux/amd64"]
+  secret = ["!reset"]
+}
+target "keep" {
+  inherits = ["base"]
+  cache-from = ["type=local,src=cache"]
+}
+`)
+
+	c, err := ParseFile(dt, "docker-bake.hcl")
+	require.NoError(t, err)
+
+	tgt, err := c.ResolveTarget("app", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=local,src=cache"}, tgt.CacheFrom)
+	require.Empty(t, tgt.CacheTo)
+	require.Equal(t, []string{"linux/amd64"}, tgt.Platforms)
+	require.Empty(t, tgt.Secrets)
+	require.Equal(t, []string{"user/base"}, tgt.Tags)
+	require.Equal(t, []string{"default"}, tgt.SSH)
+
+	tgt, err = c.ResolveTarget("keep", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=registry,ref=user/base:cache", "type=local,src=cache"}, tgt.CacheFrom)
+
+	tgt, err = c.ResolveTarget("base", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"type=registry,ref=user/base:cache"}, tgt.CacheFrom)
+}
@@ -22,9 +22,15 @@ type Opt struct {
 }
 
 type variable struct {
-	Name    string         `json:"-" hcl:"name,label"`
-	Default *hcl.Attribute `json:"default,omitempty" hcl:"default,optional"`
-	Body    hcl.Body       `json:"-" hcl:",body"`
+	Name        string                `json:"-" hcl:"name,label"`
+	Default     *hcl.Attribute        `json:"default,omitempty" hcl:"default,optional"`
+	Validations []*variableValidation `json:"validation,omitempty" hcl:"validation,block"`
+	Body        hcl.Body              `json:"-" hcl:",body"`
+}
+
+type variableValidation struct {
+	Condition    hcl.Expression `json:"condition" hcl:"condition"`
+	ErrorMessage hcl.Expression `json:"error_message" hcl:"error_message"`
 }
 
 type functionDef struct {
@@ -50,8 +56,12 @@ type parser struct {
 
 	ectx *hcl.EvalContext
 
+	blocks      map[string]map[string][]*hcl.Block
+	blockValues map[string]map[string]cty.Value
+
 	progress  map[string]struct{}
 	progressF map[string]struct{}
+	progressB map[string]struct{}
 	doneF     map[string]struct{}
 }
 
@@ -241,7 +251,159 @@ func (p *parser) resolveValue(name string) (err error) {
 	return nil
 }
 
-func Parse(b hcl.Body, opt Opt, val interface{}) hcl.Diagnostics {
+// resolveBlockDeps resolves the blocks referenced as ${type.name.attr} by the
+// attributes of the body of block typ.name, e.g. ${target.db.tags[0]}.
+func (p *parser) resolveBlockDeps(typ, name string, body hcl.Body) error {
+	key := typ + "." + name
+	if _, ok := p.progressB[key]; ok {
+		return errors.Errorf("reference cycle not allowed for %s", key)
+	}
+	p.progressB[key] = struct{}{}
+	defer delete(p.progressB, key)
+
+	attrs, _ := body.JustAttributes()
+	for _, attr := range attrs {
+		for _, v := range attr.Expr.Variables() {
+			bm, ok := p.blocks[v.RootName()]
+			if !ok {
+				continue
+			}
+			if len(v) < 2 {
+				return hcl.Diagnostics{
+					&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid reference",
+						Detail:   fmt.Sprintf("invalid reference to %s, expected %s.<name>.<attribute>", v.RootName(), v.RootName()),
+						Subject:  v.SourceRange().Ptr(),
+						Context:  v.SourceRange().Ptr(),
+					},
+				}
+			}
+			ref, ok := v[1].(hcl.TraverseAttr)
+			if !ok {
+				continue
+			}
+			blocks, ok := bm[ref.Name]
+			if !ok {
+				return hcl.Diagnostics{
+					&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid reference",
+						Detail:   fmt.Sprintf("undefined %s %q", v.RootName(), ref.Name),
+						Subject:  v.SourceRange().Ptr(),
+						Context:  v.SourceRange().Ptr(),
+					},
+				}
+			}
+			if err := p.resolveBlock(v.RootName(), ref.Name, blocks); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveBlock evaluates the attributes of the blocks defining typ.name and
+// exposes them in the eval context. Later definitions override earlier ones.
+func (p *parser) resolveBlock(typ, name string, blocks []*hcl.Block) error {
+	if _, ok := p.blockValues[typ][name]; ok {
+		return nil
+	}
+	values := map[string]cty.Value{}
+	for _, b := range blocks {
+		if err := p.resolveBlockDeps(typ, name, b.Body); err != nil {
+			return err
+		}
+		attrs, _ := b.Body.JustAttributes()
+		for k, attr := range attrs {
+			v, diags := attr.Expr.Value(p.ectx)
+			if diags.HasErrors() {
+				return diags
+			}
+			values[k] = v
+		}
+	}
+
+	if _, ok := p.blockValues[typ]; !ok {
+		p.blockValues[typ] = map[string]cty.Value{}
+	}
+	p.blockValues[typ][name] = cty.ObjectVal(values)
+	p.ectx.Variables[typ] = cty.ObjectVal(p.blockValues[typ])
+	return nil
+}
+
+// validateVariable evaluates the validation blocks of a variable against its
+// resolved value.
+func (p *parser) validateVariable(v *variable) hcl.Diagnostics {
+	for _, val := range v.Validations {
+		if diags := p.loadDeps(val.Condition, nil); diags.HasErrors() {
+			return diags
+		}
+		cond, diags := val.Condition.Value(p.ectx)
+		if diags.HasErrors() {
+			return diags
+		}
+		if !cond.Type().Equals(cty.Bool) || cond.IsNull() || !cond.IsKnown() {
+			return hcl.Diagnostics{
+				&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid validation condition",
+					Detail:   fmt.Sprintf("validation condition of variable %q must be a boolean", v.Name),
+					Subject:  val.Condition.Range().Ptr(),
+					Context:  val.Condition.Range().Ptr(),
+				},
+			}
+		}
+		if cond.True() {
+			continue
+		}
+		if diags := p.loadDeps(val.ErrorMessage, nil); diags.HasErrors() {
+			return diags
+		}
+		msg, diags := val.ErrorMessage.Value(p.ectx)
+		if diags.HasErrors() {
+			return diags
+		}
+		if !msg.Type().Equals(cty.String) || msg.IsNull() || !msg.IsKnown() {
+			return hcl.Diagnostics{
+				&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid validation error message",
+					Detail:   fmt.Sprintf("validation error message of variable %q must be a string", v.Name),
+					Subject:  val.ErrorMessage.Range().Ptr(),
+					Context:  val.ErrorMessage.Range().Ptr(),
+				},
+			}
+		}
+		return hcl.Diagnostics{
+			&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for variable",
+				Detail:   msg.AsString(),
+				Subject:  val.Condition.Range().Ptr(),
+				Context:  val.Condition.Range().Ptr(),
+			},
+		}
+	}
+	return nil
+}
+
+// ParseMeta holds information about the blocks decoded by Parse.
+type ParseMeta struct {
+	// Renamed maps the type and label of the blocks defining a matrix to
+	// the names of the blocks created for each combination.
+	Renamed map[string]map[string][]string
+}
+
+func Parse(b hcl.Body, opt Opt, val interface{}) (*ParseMeta, hcl.Diagnostics) {
+	meta := &ParseMeta{Renamed: map[string]map[string][]string{}}
+	if diags := parse(b, opt, val, meta); diags.HasErrors() {
+		return nil, diags
+	}
+	return meta, nil
+}
+
+func parse(b hcl.Body, opt Opt, val interface{}, meta *ParseMeta) hcl.Diagnostics {
 	reserved := map[string]struct{}{}
 	schema, _ := gohcl.ImpliedBodySchema(val)
 
@@ -277,8 +439,12 @@ func Parse(b hcl.Body, opt Opt, val interface{}) hcl.Diagnostics {
 		attrs: map[string]*hcl.Attribute{},
 		funcs: map[string]*functionDef{},
 
+		blocks:      map[string]map[string][]*hcl.Block{},
+		blockValues: map[string]map[string]cty.Value{},
+
 		progress:  map[string]struct{}{},
 		progressF: map[string]struct{}{},
+		progressB: map[string]struct{}{},
 		doneF:     map[string]struct{}{},
 		ectx: &hcl.EvalContext{
 			Variables: map[string]cty.Value{},
@@ -365,6 +531,15 @@ func Parse(b hcl.Body, opt Opt, val interface{}) hcl.Diagnostics {
 		}
 	}
 
+	for _, v := range defs.Variables {
+		if _, ok := reserved[v.Name]; ok {
+			continue
+		}
+		if diags := p.validateVariable(v); diags.HasErrors() {
+			return diags
+		}
+	}
+
 	for k := range p.funcs {
 		if err := p.resolveFunction(k); err != nil {
 			if diags, ok := err.(hcl.Diagnostics); ok {
@@ -394,7 +569,7 @@ func Parse(b hcl.Body, opt Opt, val interface{}) hcl.Diagnostics {
 		}
 	}
 
-	m := map[string]map[string][]*hcl.Block{}
+	m := p.blocks
 	for _, b := range content.Blocks {
 		if len(b.Labels) == 0 || len(b.Labels) > 1 {
 			return hcl.Diagnostics{
@@ -450,52 +625,77 @@ func Parse(b hcl.Body, opt Opt, val interface{}) hcl.Diagnostics {
 			continue
 		}
 
-		vv := reflect.New(t.typ.Elem().Elem())
-		diag := gohcl.DecodeBody(b.Body, p.ectx, vv.Interface())
-		if diag.HasErrors() {
-			diags = append(diags, diag...)
-			continue
-		}
-
-		if err := opt.ValidateLabel(b.Labels[0]); err != nil {
+		if err := p.resolveBlockDeps(b.Type, b.Labels[0], b.Body); err != nil {
+			if diags, ok := err.(hcl.Diagnostics); ok {
+				return diags
+			}
 			return hcl.Diagnostics{
 				&hcl.Diagnostic{
 					Severity: hcl.DiagError,
-					Summary:  "Invalid name",
+					Summary:  "Invalid reference",
 					Detail:   err.Error(),
-					Subject:  &b.LabelRanges[0],
+					Subject:  &b.DefRange,
+					Context:  &b.DefRange,
 				},
 			}
 		}
 
-		lblIndex := setLabel(vv, b.Labels[0])
+		bvs, diag := p.decodeBlock(b, t.typ.Elem().Elem())
+		if diag.HasErrors() {
+			diags = append(diags, diag...)
+			continue
+		}
+		if len(bvs) != 1 || bvs[0].name != b.Labels[0] {
+			if meta.Renamed[b.Type] == nil {
+				meta.Renamed[b.Type] = map[string][]string{}
+			}
+			for _, bv := range bvs {
+				meta.Renamed[b.Type][b.Labels[0]] = append(meta.Renamed[b.Type][b.Labels[0]], bv.name)
+			}
+		}
 
-		oldValue, exists := t.values[b.Labels[0]]
-		if !exists && lblIndex != -1 {
-			if v.Elem().Field(t.idx).Type().Kind() == reflect.Slice {
-				for i := 0; i < v.Elem().Field(t.idx).Len(); i++ {
-					if b.Labels[0] == v.Elem().Field(t.idx).Index(i).Elem().Field(lblIndex).String() {
-						exists = true
-						oldValue = value{Value: v.Elem().Field(t.idx).Index(i), idx: i}
-						break
-					}
+		for _, bv := range bvs {
+			vv := bv.value
+			if err := opt.ValidateLabel(bv.name); err != nil {
+				return hcl.Diagnostics{
+					&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid name",
+						Detail:   err.Error(),
+						Subject:  &b.LabelRanges[0],
+					},
 				}
 			}
 
-		}
-		if exists {
-			if m := oldValue.Value.MethodByName("Merge"); m.IsValid() {
-				m.Call([]reflect.Value{vv})
-			} else {
-				v.Elem().Field(t.idx).Index(oldValue.idx).Set(vv)
+			lblIndex := setLabel(vv, bv.name)
+
+			oldValue, exists := t.values[bv.name]
+			if !exists && lblIndex != -1 {
+				if v.Elem().Field(t.idx).Type().Kind() == reflect.Slice {
+					for i := 0; i < v.Elem().Field(t.idx).Len(); i++ {
+						if bv.name == v.Elem().Field(t.idx).Index(i).Elem().Field(lblIndex).String() {
+							exists = true
+							oldValue = value{Value: v.Elem().Field(t.idx).Index(i), idx: i}
+							break
+						}
+					}
+				}
+
 			}
-		} else {
-			slice := v.Elem().Field(t.idx)
-			if slice.IsNil() {
-				slice = reflect.New(t.typ).Elem()
+			if exists {
+				if m := oldValue.Value.MethodByName("Merge"); m.IsValid() {
+					m.Call([]reflect.Value{vv})
+				} else {
+					v.Elem().Field(t.idx).Index(oldValue.idx).Set(vv)
+				}
+			} else {
+				slice := v.Elem().Field(t.idx)
+				if slice.IsNil() {
+					slice = reflect.New(t.typ).Elem()
+				}
+				t.values[bv.name] = value{Value: vv, idx: slice.Len()}
+				v.Elem().Field(t.idx).Set(reflect.Append(slice, vv))
 			}
-			t.values[b.Labels[0]] = value{Value: vv, idx: slice.Len()}
-			v.Elem().Field(t.idx).Set(reflect.Append(slice, vv))
 		}
 	}
 	if diags.HasErrors() {
@@ -0,0 +1,154 @@
+package hclparser
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+var matrixSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "matrix"},
+		{Name: "name"},
+	},
+}
+
+type blockValue struct {
+	name  string
+	value reflect.Value
+}
+
+// decodeBlock decodes the body of b into a new value of typ. If the block
+// defines a matrix attribute, a value is decoded for each combination of the
+// matrix with the current combination available as the matrix variable. The
+// name attribute sets the name of each value and defaults to the block label
+// followed by the combination values.
+func (p *parser) decodeBlock(b *hcl.Block, typ reflect.Type) ([]blockValue, hcl.Diagnostics) {
+	content, remain, diags := b.Body.PartialContent(matrixSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	matrix, ok := content.Attributes["matrix"]
+	if !ok {
+		vv := reflect.New(typ)
+		if diags := gohcl.DecodeBody(b.Body, p.ectx, vv.Interface()); diags.HasErrors() {
+			return nil, diags
+		}
+		return []blockValue{{name: b.Labels[0], value: vv}}, nil
+	}
+
+	combos, diags := p.matrixCombinations(matrix)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	var bvs []blockValue
+	for _, combo := range combos {
+		ectx := p.ectx.NewChild()
+		ectx.Variables = map[string]cty.Value{
+			"matrix": cty.ObjectVal(combo.values),
+		}
+
+		name := b.Labels[0] + "-" + strings.Join(combo.names, "-")
+		if attr, ok := content.Attributes["name"]; ok {
+			v, diags := attr.Expr.Value(ectx)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			v, err := convert.Convert(v, cty.String)
+			if err != nil || v.IsNull() || !v.IsKnown() {
+				return nil, hcl.Diagnostics{
+					&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid name",
+						Detail:   "name of a matrix block must be a string",
+						Subject:  attr.Expr.Range().Ptr(),
+						Context:  attr.Expr.Range().Ptr(),
+					},
+				}
+			}
+			name = v.AsString()
+		}
+
+		vv := reflect.New(typ)
+		if diags := gohcl.DecodeBody(remain, ectx, vv.Interface()); diags.HasErrors() {
+			return nil, diags
+		}
+		bvs = append(bvs, blockValue{name: name, value: vv})
+	}
+	return bvs, nil
+}
+
+type matrixCombination struct {
+	values map[string]cty.Value
+	names  []string
+}
+
+// matrixCombinations returns the cartesian product of the lists of the matrix
+// map, ordered by key.
+func (p *parser) matrixCombinations(attr *hcl.Attribute) ([]matrixCombination, hcl.Diagnostics) {
+	invalid := func(detail string) hcl.Diagnostics {
+		return hcl.Diagnostics{
+			&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid matrix",
+				Detail:   detail,
+				Subject:  attr.Expr.Range().Ptr(),
+				Context:  attr.Expr.Range().Ptr(),
+			},
+		}
+	}
+
+	mv, diags := attr.Expr.Value(p.ectx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if mv.IsNull() || !mv.IsKnown() || !(mv.Type().IsObjectType() || mv.Type().IsMapType()) {
+		return nil, invalid("matrix must be a map of lists")
+	}
+
+	m := mv.AsValueMap()
+	if len(m) == 0 {
+		return nil, invalid("matrix must not be empty")
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	combos := []matrixCombination{{values: map[string]cty.Value{}}}
+	for _, k := range keys {
+		v := m[k]
+		if v.IsNull() || !v.IsKnown() || !v.CanIterateElements() || v.Type().IsMapType() || v.Type().IsObjectType() {
+			return nil, invalid(fmt.Sprintf("matrix value %q must be a list", k))
+		}
+		if v.LengthInt() == 0 {
+			return nil, invalid(fmt.Sprintf("matrix value %q must not be empty", k))
+		}
+		var next []matrixCombination
+		for _, c := range combos {
+			for _, ev := range v.AsValueSlice() {
+				sv, err := convert.Convert(ev, cty.String)
+				if err != nil || sv.IsNull() || !sv.IsKnown() {
+					return nil, invalid(fmt.Sprintf("matrix value %q must only contain primitive values", k))
+				}
+				values := make(map[string]cty.Value, len(c.values)+1)
+				for kk, vv := range c.values {
+					values[kk] = vv
+				}
+				values[k] = ev
+				names := append(append([]string{}, c.names...), sv.AsString())
+				next = append(next, matrixCombination{values: values, names: names})
+			}
+		}
+		combos = next
+	}
+	return combos, nil
+}
@@ -1,12 +1,14 @@
 package hclparser
 
 import (
+	"github.com/compose-spec/compose-go/dotenv"
 	"github.com/hashicorp/go-cty-funcs/cidr"
 	"github.com/hashicorp/go-cty-funcs/crypto"
 	"github.com/hashicorp/go-cty-funcs/encoding"
 	"github.com/hashicorp/go-cty-funcs/uuid"
 	"github.com/hashicorp/hcl/v2/ext/tryfunc"
 	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/function"
 	"github.com/zclconf/go-cty/cty/function/stdlib"
 )
@@ -38,6 +40,7 @@ var stdlibFunctions = map[string]function.Function{
 	"distinct":               stdlib.DistinctFunc,
 	"divide":                 stdlib.DivideFunc,
 	"element":                stdlib.ElementFunc,
+	"envfile":                envfileFunc,
 	"equal":                  stdlib.EqualFunc,
 	"flatten":                stdlib.FlattenFunc,
 	"floor":                  stdlib.FloorFunc,
@@ -109,3 +112,28 @@ var stdlibFunctions = map[string]function.Function{
 	"values":                 stdlib.ValuesFunc,
 	"zipmap":                 stdlib.ZipmapFunc,
 }
+
+// envfileFunc reads a dotenv file and returns its content as a map of strings.
+var envfileFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "filename",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.Map(cty.String)),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		env, err := dotenv.Read(args[0].AsString())
+		if err != nil {
+			return cty.NilVal, err
+		}
+		if len(env) == 0 {
+			return cty.MapValEmpty(cty.String), nil
+		}
+		m := make(map[string]cty.Value, len(env))
+		for k, v := range env {
+			m[k] = cty.StringVal(v)
+		}
+		return cty.MapVal(m), nil
+	},
+})
@@ -0,0 +1,192 @@
+package bake
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// LockfileName is the name of the file written next to the bake definition
+// to pin the base images of the targets.
+const LockfileName = "bake.lock"
+
+// lockfileVersion is the version of the lockfile format written by
+// GenerateLockfile.
+const lockfileVersion = 1
+
+var dockerfileFromPattern = regexp.MustCompile(`(?im)^\s*FROM\s+(?:--\S+\s+)*(\S+)(?:\s+AS\s+(\S+))?\s*$`)
+
+// ImageResolver resolves an image reference to the descriptor of its
+// manifest in the registry. It is satisfied by imagetools.Resolver.
+type ImageResolver interface {
+	Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error)
+}
+
+// Lockfile pins the base images of the targets to a digest.
+type Lockfile struct {
+	Version int                     `json:"version"`
+	Targets map[string]LockedTarget `json:"targets"`
+}
+
+// LockedTarget holds the pinned base images of a target, keyed by the
+// reference used in the FROM instructions of its dockerfile. Values are the
+// normalized references with the resolved digest.
+type LockedTarget struct {
+	Images map[string]string `json:"images"`
+}
+
+// GenerateLockfile resolves the base images of the dockerfile of each target
+// with r. Stages, scratch, references using build args and references already
+// pinned to a digest are skipped, as are dockerfiles that are not available
+// locally.
+func GenerateLockfile(ctx context.Context, m map[string]*Target, r ImageResolver) (*Lockfile, error) {
+	l := &Lockfile{
+		Version: lockfileVersion,
+		Targets: map[string]LockedTarget{},
+	}
+	resolved := map[string]string{}
+	for name, t := range m {
+		dt, err := t.readDockerfile()
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", name)
+		}
+		images := map[string]string{}
+		for _, ref := range dockerfileBaseImages(dt) {
+			if _, ok := images[ref]; ok {
+				continue
+			}
+			pinned, ok := resolved[ref]
+			if !ok {
+				named, err := reference.ParseNormalizedNamed(ref)
+				if err != nil {
+					return nil, errors.Wrapf(err, "target %s: invalid base image %s", name, ref)
+				}
+				named = reference.TagNameOnly(named)
+				_, desc, err := r.Resolve(ctx, named.String())
+				if err != nil {
+					return nil, errors.Wrapf(err, "target %s: failed to resolve base image %s", name, ref)
+				}
+				canonical, err := reference.WithDigest(named, desc.Digest)
+				if err != nil {
+					return nil, errors.Wrapf(err, "target %s: invalid digest for base image %s", name, ref)
+				}
+				pinned = canonical.String()
+				resolved[ref] = pinned
+			}
+			images[ref] = pinned
+		}
+		if len(images) > 0 {
+			l.Targets[name] = LockedTarget{Images: images}
+		}
+	}
+	return l, nil
+}
+
+// LockfilePath returns the path of the lockfile next to the first local bake
+// definition of files. The current directory is used if files are only read
+// from stdin.
+func LockfilePath(files []File) string {
+	for _, f := range files {
+		if f.Name != "-" {
+			return filepath.Join(filepath.Dir(f.Name), LockfileName)
+		}
+	}
+	return LockfileName
+}
+
+// ReadLockfile reads the lockfile at fn. It returns nil if the file does not
+// exist.
+func ReadLockfile(fn string) (*Lockfile, error) {
+	dt, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var l Lockfile
+	if err := json.Unmarshal(dt, &l); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse lockfile %s", fn)
+	}
+	if l.Version != lockfileVersion {
+		return nil, errors.Errorf("unsupported lockfile version %d in %s", l.Version, fn)
+	}
+	return &l, nil
+}
+
+// WriteLockfile writes l to fn.
+func WriteLockfile(fn string, l *Lockfile) error {
+	dt, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(dt, '\n'), 0644)
+}
+
+// ApplyLockfile pins the base images of the targets found in l by setting a
+// docker-image named context for each of them. Named contexts already set on a
+// target take precedence.
+func ApplyLockfile(m map[string]*Target, l *Lockfile) {
+	if l == nil {
+		return
+	}
+	for name, t := range m {
+		lt, ok := l.Targets[name]
+		if !ok {
+			continue
+		}
+		for ref, pinned := range lt.Images {
+			if _, ok := t.Contexts[ref]; ok {
+				continue
+			}
+			if t.Contexts == nil {
+				t.Contexts = map[string]string{}
+			}
+			t.Contexts[ref] = "docker-image://" + pinned
+		}
+	}
+}
+
+// dockerfileBaseImages returns the images referenced by the FROM instructions
+// of dt, in order, that can be pinned.
+func dockerfileBaseImages(dt string) []string {
+	var refs []string
+	stages := map[string]struct{}{}
+	for _, m := range dockerfileFromPattern.FindAllStringSubmatch(dt, -1) {
+		ref := m[1]
+		_, isStage := stages[strings.ToLower(ref)]
+		if m[2] != "" {
+			// stage names are case-insensitive
+			stages[strings.ToLower(m[2])] = struct{}{}
+		}
+		if isStage || strings.EqualFold(ref, "scratch") || strings.Contains(ref, "$") || strings.Contains(ref, "@") {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// readDockerfile returns the content of the dockerfile of the target, or an
+// empty string if it is not available locally.
+func (t *Target) readDockerfile() (string, error) {
+	if t.DockerfileInline != nil {
+		return *t.DockerfileInline, nil
+	}
+	fn, _, ok, err := t.localDockerfilePath()
+	if err != nil || !ok {
+		return "", err
+	}
+	dt, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	return string(dt), nil
+}
@@ -0,0 +1,124 @@
+package bake
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type mockResolver struct {
+	digests  map[string]digest.Digest
+	resolved []string
+}
+
+func (r *mockResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	r.resolved = append(r.resolved, ref)
+	dgst, ok := r.digests[ref]
+	if !ok {
+		return "", ocispec.Descriptor{}, errors.Errorf("%s: not found", ref)
+	}
+	return ref, ocispec.Descriptor{Digest: dgst}, nil
+}
+
+func TestLockfile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(`
+ARG GO_VERSION=1.18
+FROM golang:${GO_VERSION} AS golang
+FROM --platform=$BUILDPLATFORM alpine:3.16 AS base
+FROM base AS build
+FROM scratch
+COPY --from=build / /
+`), 0644))
+
+	alpine := digest.FromString("alpine")
+	busybox := digest.FromString("busybox")
+	r := &mockResolver{digests: map[string]digest.Digest{
+		"docker.io/library/alpine:3.16":    alpine,
+		"docker.io/library/busybox:latest": busybox,
+	}}
+
+	app := filepath.Join(dir, "Dockerfile")
+	inline := "FROM alpine:3.16\nFROM busybox\nFROM debian@" + digest.FromString("debian").String() + "\n"
+	m := map[string]*Target{
+		"app":    {Dockerfile: &app},
+		"inline": {DockerfileInline: &inline},
+	}
+
+	l, err := GenerateLockfile(context.TODO(), m, r)
+	require.NoError(t, err)
+	require.Equal(t, &Lockfile{
+		Version: 1,
+		Targets: map[string]LockedTarget{
+			"app": {Images: map[string]string{
+				"alpine:3.16": "docker.io/library/alpine:3.16@" + alpine.String(),
+			}},
+			"inline": {Images: map[string]string{
+				"alpine:3.16": "docker.io/library/alpine:3.16@" + alpine.String(),
+				"busybox":     "docker.io/library/busybox:latest@" + busybox.String(),
+			}},
+		},
+	}, l)
+	// base images shared by targets are resolved once
+	require.Len(t, r.resolved, 2)
+
+	fn := filepath.Join(dir, LockfileName)
+	require.NoError(t, WriteLockfile(fn, l))
+	dt, err := os.ReadFile(fn)
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "version": 1,
+  "targets": {
+    "app": {
+      "images": {
+        "alpine:3.16": "docker.io/library/alpine:3.16@`+alpine.String()+`"
+      }
+    },
+    "inline": {
+      "images": {
+        "alpine:3.16": "docker.io/library/alpine:3.16@`+alpine.String()+`",
+        "busybox": "docker.io/library/busybox:latest@`+busybox.String()+`"
+      }
+    }
+  }
+}
+`, string(dt))
+
+	l2, err := ReadLockfile(fn)
+	require.NoError(t, err)
+	require.Equal(t, l, l2)
+
+	m["inline"].Contexts = map[string]string{"busybox": "docker-image://busybox:1.35"}
+	ApplyLockfile(m, l2)
+	require.Equal(t, map[string]string{
+		"alpine:3.16": "docker-image://docker.io/library/alpine:3.16@" + alpine.String(),
+	}, m["app"].Contexts)
+	require.Equal(t, map[string]string{
+		"alpine:3.16": "docker-image://docker.io/library/alpine:3.16@" + alpine.String(),
+		"busybox":     "docker-image://busybox:1.35",
+	}, m["inline"].Contexts)
+
+	l3, err := ReadLockfile(filepath.Join(dir, "missing.lock"))
+	require.NoError(t, err)
+	require.Nil(t, l3)
+
+	unknown := "FROM foo/bar\n"
+	_, err = GenerateLockfile(context.TODO(), map[string]*Target{
+		"unknown": {DockerfileInline: &unknown},
+	}, r)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target unknown: failed to resolve base image foo/bar")
+}
+
+func TestLockfilePath(t *testing.T) {
+	require.Equal(t, "bake.lock", LockfilePath(nil))
+	require.Equal(t, "bake.lock", LockfilePath([]File{{Name: "-"}}))
+	require.Equal(t, "bake.lock", LockfilePath([]File{{Name: "docker-bake.hcl"}}))
+	require.Equal(t, filepath.Join("sub", "bake.lock"), LockfilePath([]File{{Name: "-"}, {Name: "sub/docker-bake.hcl"}, {Name: "docker-bake.hcl"}}))
+}
@@ -0,0 +1,120 @@
+package bake
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// PlatformEmulationWarnings returns a warning for each target platform that
+// none of the supported platforms, typically the platforms of the builder
+// workers, can run. Builders list the platforms they can emulate, so these
+// platforms require emulation, e.g. with QEMU, to be set up on the builder.
+// The local platform and invalid platforms, reported by the build, are
+// skipped. Targets without platforms are built for the builder platform.
+func PlatformEmulationWarnings(m map[string]*Target, supported []specs.Platform) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make([]platforms.Matcher, 0, len(supported))
+	for _, p := range supported {
+		matchers = append(matchers, platforms.Only(p))
+	}
+	var warnings []string
+	for _, name := range names {
+		for _, v := range m[name].Platforms {
+			if v == "local" {
+				continue
+			}
+			p, err := platforms.Parse(v)
+			if err != nil {
+				continue
+			}
+			if !matchPlatform(matchers, p) {
+				warnings = append(warnings, fmt.Sprintf("target %s: platform %s is not supported by the builder and requires emulation, e.g. with QEMU", name, v))
+			}
+		}
+	}
+	return warnings
+}
+
+func matchPlatform(matchers []platforms.Matcher, p specs.Platform) bool {
+	for _, m := range matchers {
+		if m.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPlatforms sets platforms on the resolved targets that don't define
+// any. Comma separated platforms are split. Targets with platforms, either
+// defined or overridden, are left untouched. Outputs of the updated targets
+// are validated again against their platforms.
+func DefaultPlatforms(m map[string]*Target, platforms []string) error {
+	if len(platforms) == 0 {
+		return nil
+	}
+	platforms = dedupePlatforms(splitPlatforms(platforms))
+	for name, t := range m {
+		if len(t.Platforms) != 0 {
+			continue
+		}
+		t.Platforms = copySlice(platforms)
+		if err := t.validatePlatformOutputs(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpandPlatforms replaces the os-only platforms of the resolved targets, like
+// linux, with the platforms of that os supported by the builder building the
+// target, typically the platforms of its workers. supported is only called for
+// the builders of targets with os-only platforms, with the empty name for the
+// default builder. Outputs are validated again against the expanded platforms.
+func ExpandPlatforms(m map[string]*Target, supported func(builder string) ([]specs.Platform, error)) error {
+	for name, t := range m {
+		var res []string
+		expanded := false
+		for _, v := range t.Platforms {
+			if strings.Contains(v, "/") || v == "local" {
+				res = append(res, v)
+				continue
+			}
+			expanded = true
+			builder := ""
+			if t.Builder != nil {
+				builder = *t.Builder
+			}
+			ps, err := supported(builder)
+			if err != nil {
+				return err
+			}
+			n := len(res)
+			for _, p := range ps {
+				if p.OS == strings.ToLower(v) {
+					res = append(res, platforms.Format(p))
+				}
+			}
+			if len(res) == n {
+				return errors.Errorf("target %s: no platform supported by the builder for %s", name, v)
+			}
+		}
+		if !expanded {
+			continue
+		}
+		t.Platforms = dedupePlatforms(res)
+		if err := t.validatePlatformOutputs(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
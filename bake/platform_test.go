@@ -0,0 +1,169 @@
+package bake
+
+import (
+	"context"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlatformEmulationWarnings(t *testing.T) {
+	m := map[string]*Target{
+		"app": {
+			Platforms: []string{"linux/amd64", "linux/arm64"},
+		},
+		"legacy": {
+			Platforms: []string{"linux/386"},
+		},
+		"local": {
+			Platforms: []string{"local"},
+		},
+		"invalid": {
+			Platforms: []string{"linux/invalid!"},
+		},
+		"host": {},
+	}
+
+	warnings := PlatformEmulationWarnings(m, []specs.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "386"},
+	})
+	require.Equal(t, []string{
+		"target app: platform linux/arm64 is not supported by the builder and requires emulation, e.g. with QEMU",
+	}, warnings)
+
+	warnings = PlatformEmulationWarnings(m, []specs.Platform{
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	})
+	require.Equal(t, 2, len(warnings))
+	require.Contains(t, warnings[0], "target app: platform linux/amd64")
+	require.Contains(t, warnings[1], "target legacy: platform linux/386")
+
+	warnings = PlatformEmulationWarnings(m, []specs.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "linux", Architecture: "386"},
+	})
+	require.Nil(t, warnings)
+}
+
+func TestExpandPlatforms(t *testing.T) {
+	builders := map[string][]specs.Platform{
+		"": {
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "arm64"},
+			{OS: "linux", Architecture: "arm", Variant: "v7"},
+			{OS: "windows", Architecture: "amd64"},
+		},
+		"remote": {
+			{OS: "linux", Architecture: "ppc64le"},
+		},
+	}
+	var booted []string
+	supported := func(name string) ([]specs.Platform, error) {
+		booted = append(booted, name)
+		return builders[name], nil
+	}
+	remote := "remote"
+	m := map[string]*Target{
+		"app": {
+			Platforms: []string{"linux"},
+		},
+		"mixed": {
+			Platforms: []string{"linux/amd64", "windows"},
+		},
+		"pinned": {
+			Builder:   &remote,
+			Platforms: []string{"linux"},
+		},
+		"canonical": {
+			Platforms: []string{"linux/arm64/v8", "linux"},
+		},
+		"host": {},
+	}
+
+	require.NoError(t, ExpandPlatforms(m, supported))
+	require.Equal(t, []string{"linux/arm64", "linux/amd64", "linux/arm/v7"}, m["canonical"].Platforms)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64", "linux/arm/v7"}, m["app"].Platforms)
+	require.Equal(t, []string{"linux/amd64", "windows/amd64"}, m["mixed"].Platforms)
+	require.Equal(t, []string{"linux/ppc64le"}, m["pinned"].Platforms)
+	require.Nil(t, m["host"].Platforms)
+
+	booted = nil
+	m = map[string]*Target{
+		"app": {
+			Platforms: []string{"linux/amd64"},
+		},
+	}
+	require.NoError(t, ExpandPlatforms(m, supported))
+	require.Nil(t, booted)
+
+	m = map[string]*Target{
+		"app": {
+			Platforms: []string{"darwin"},
+		},
+	}
+	err := ExpandPlatforms(m, supported)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target app: no platform supported by the builder for darwin")
+
+	m = map[string]*Target{
+		"app": {
+			Platforms: []string{"linux"},
+			Outputs:   []string{"type=docker"},
+		},
+	}
+	err = ExpandPlatforms(m, supported)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target app: docker exporter does not support multiple platforms")
+}
+
+func TestDefaultPlatforms(t *testing.T) {
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+group "default" {
+  targets = ["app", "inherited", "overridden", "host"]
+}
+
+target "base" {
+  platforms = ["linux/arm64"]
+}
+
+target "app" {
+  platforms = ["linux/amd64"]
+}
+
+target "inherited" {
+  inherits = ["base"]
+}
+
+target "overridden" {
+}
+
+target "host" {
+}`),
+	}
+
+	m, _, err := ReadTargets(context.TODO(), []File{fp}, []string{"default"}, []string{"overridden.platform=linux/ppc64le"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, DefaultPlatforms(m, []string{"linux/amd64,linux/arm/v7", "linux/x86_64"}))
+	require.Equal(t, []string{"linux/amd64"}, m["app"].Platforms)
+	require.Equal(t, []string{"linux/arm64"}, m["inherited"].Platforms)
+	require.Equal(t, []string{"linux/ppc64le"}, m["overridden"].Platforms)
+	require.Equal(t, []string{"linux/amd64", "linux/arm/v7"}, m["host"].Platforms)
+
+	m, _, err = ReadTargets(context.TODO(), []File{fp}, []string{"host"}, []string{"host.load=true"}, nil)
+	require.NoError(t, err)
+	err = DefaultPlatforms(m, []string{"linux/amd64", "linux/arm64"})
+	require.Error(t, err)
+	require.Equal(t, "target host: load is not supported for multiple platforms [linux/amd64 linux/arm64]", err.Error())
+
+	m, _, err = ReadTargets(context.TODO(), []File{fp}, []string{"host"}, []string{"host.output=type=docker"}, nil)
+	require.NoError(t, err)
+	err = DefaultPlatforms(m, []string{"linux/amd64,linux/arm64"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target host: docker exporter does not support multiple platforms")
+}
@@ -107,7 +107,7 @@ func detectGitContext(ref string) (*llb.State, bool) {
 		found = true
 	}
 
-	for _, prefix := range []string{"git://", "github.com/", "git@"} {
+	for _, prefix := range []string{"git://", "ssh://", "github.com/", "git@"} {
 		if strings.HasPrefix(ref, prefix) {
 			found = true
 			break
@@ -0,0 +1,68 @@
+package bake
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadValuesFiles reads the HCL variable values of the JSON or YAML files
+// fns, holding a mapping of variable names to string, number or boolean
+// values. Values of later files take precedence. Null values are ignored.
+func ReadValuesFiles(fns []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, fn := range fns {
+		dt, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read values file %s", fn)
+		}
+		if err := parseValues(dt, values); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse values file %s", fn)
+		}
+	}
+	return values, nil
+}
+
+func parseValues(dt []byte, values map[string]string) error {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(dt, &m); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	// report errors in a stable order
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch v := m[k].(type) {
+		case nil:
+		case string:
+			values[k] = v
+		case bool:
+			values[k] = strconv.FormatBool(v)
+		case int:
+			values[k] = strconv.Itoa(v)
+		case float64:
+			values[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return errors.Errorf("value of %s must be a string, a number or a boolean", k)
+		}
+	}
+	return nil
+}
+
+// lookupVarWithValues returns a variable lookup function preferring the
+// environment over values.
+func lookupVarWithValues(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := values[name]
+		return v, ok
+	}
+}
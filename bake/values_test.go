@@ -0,0 +1,77 @@
+package bake
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTargetsValues(t *testing.T) {
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "values.yaml")
+	require.NoError(t, os.WriteFile(yml, []byte(`
+VERSION: "1.2"
+REPLICAS: 3
+PUSH: true
+TAG: v1
+`), 0644))
+	jsn := filepath.Join(dir, "values.json")
+	require.NoError(t, os.WriteFile(jsn, []byte(`{"TAG": "v2", "UNUSED": null}`), 0644))
+
+	values, err := ReadValuesFiles([]string{yml, jsn})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"VERSION":  "1.2",
+		"REPLICAS": "3",
+		"PUSH":     "true",
+		"TAG":      "v2",
+	}, values)
+
+	fp := File{
+		Name: "docker-bake.hcl",
+		Data: []byte(`
+variable "VERSION" {
+  default = "1.0"
+}
+variable "REPLICAS" {
+  default = 1
+}
+variable "PUSH" {
+  default = false
+}
+variable "TAG" {
+  default = "latest"
+}
+variable "DISTRO" {
+  default = "alpine"
+}
+
+target "app" {
+  args = {
+    VERSION = VERSION
+    REPLICAS = REPLICAS + 1
+    DISTRO = DISTRO
+  }
+  tags = ["app:${TAG}"]
+  push = PUSH
+}`),
+	}
+	ctx := context.TODO()
+
+	t.Setenv("VERSION", "2.0")
+	m, _, _, err := ReadTargetsWithOpt(ctx, []File{fp}, []string{"app"}, nil, ReadOpt{ParseOpt: ParseOpt{Values: values}})
+	require.NoError(t, err)
+	// the environment takes precedence over values, which take precedence
+	// over defaults
+	require.Equal(t, map[string]string{"VERSION": "2.0", "REPLICAS": "4", "DISTRO": "alpine"}, m["app"].Args)
+	require.Equal(t, []string{"app:v2"}, m["app"].Tags)
+	require.Equal(t, true, *m["app"].Push)
+
+	require.NoError(t, os.WriteFile(yml, []byte("TAGS: [a, b]\n"), 0644))
+	_, err = ReadValuesFiles([]string{yml})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to parse values file "+yml+": value of TAGS must be a string, a number or a boolean")
+}
@@ -54,10 +54,20 @@ var (
 	errDockerfileConflict = errors.New("ambiguous Dockerfile source: both stdin and flag correspond to Dockerfiles")
 )
 
+// CallResultKey is the key of the output of the frontend method called with
+// Options.CallFunc, in the metadata of the result and in the exporter
+// response.
+const CallResultKey = "result.txt"
+
+// CallResultJSONKey is the key of the structured output of the frontend
+// method, like the warnings reported by lint, when the frontend sets it.
+const CallResultJSONKey = "result.json"
+
 type Options struct {
 	Inputs Inputs
 
 	Allow         []entitlements.Entitlement
+	Annotations   map[string]string
 	BuildArgs     map[string]string
 	CacheFrom     []client.CacheOptionsEntry
 	CacheTo       []client.CacheOptionsEntry
@@ -77,6 +87,11 @@ type Options struct {
 	Target        string
 	Ulimits       *opts.UlimitOpt
 
+	// CallFunc is the frontend method run instead of building, like lint or
+	// outline. Results are not exported, the output of the method is set in
+	// the CallResultKey and CallResultJSONKey keys of the exporter response.
+	CallFunc string
+
 	// Linked marks this target as exclusively linked (not requested by the user).
 	Linked bool
 }
@@ -434,11 +449,15 @@ func toSolveOpt(ctx context.Context, di DriverInfo, multiDriver bool, opt Option
 		so.FrontendAttrs["multi-platform"] = "true"
 	}
 
+	if opt.CallFunc != "" {
+		opt.Exports = nil
+	}
+
 	switch len(opt.Exports) {
 	case 1:
 		// valid
 	case 0:
-		if d.IsMobyDriver() && !noDefaultLoad() {
+		if d.IsMobyDriver() && !noDefaultLoad() && opt.CallFunc == "" {
 			// backwards compat for docker driver only:
 			// this ensures the build results in a docker image.
 			opt.Exports = []client.ExportEntry{{Type: "image", Attrs: map[string]string{}}}
@@ -524,6 +543,10 @@ func toSolveOpt(ctx context.Context, di DriverInfo, multiDriver bool, opt Option
 			if v, ok := opt.BuildArgs["BUILDKIT_INLINE_BUILDINFO_ATTRS"]; ok {
 				e.Attrs["buildinfo-attrs"] = v
 			}
+			// annotations are keyed by their exporter attribute
+			for k, v := range opt.Annotations {
+				e.Attrs[k] = v
+			}
 		}
 	}
 
@@ -549,6 +572,9 @@ func toSolveOpt(ctx context.Context, di DriverInfo, multiDriver bool, opt Option
 	if opt.Target != "" {
 		so.FrontendAttrs["target"] = opt.Target
 	}
+	if opt.CallFunc != "" {
+		so.FrontendAttrs["requestid"] = "frontend." + opt.CallFunc
+	}
 	if len(opt.NoCacheFilter) > 0 {
 		so.FrontendAttrs["no-cache"] = strings.Join(opt.NoCacheFilter, ",")
 	}
@@ -636,7 +662,7 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, do
 	if noMobyDriver != nil && !noDefaultLoad() {
 		var noOutputTargets []string
 		for name, opt := range opt {
-			if !opt.Linked && len(opt.Exports) == 0 {
+			if !opt.Linked && len(opt.Exports) == 0 && opt.CallFunc == "" {
 				noOutputTargets = append(noOutputTargets, name)
 			}
 		}
@@ -927,17 +953,31 @@ func Build(ctx context.Context, drivers []DriverInfo, opt map[string]Options, do
 						ch, done := progress.NewChannel(pw)
 						defer func() { <-done }()
 
+						var callResult, callResultJSON []byte
 						rr, err := c.Build(ctx, so, "buildx", func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
 							res, err := c.Solve(ctx, req)
 							if err != nil {
 								return nil, err
 							}
+							if opt.CallFunc != "" {
+								callResult = res.Metadata[CallResultKey]
+								callResultJSON = res.Metadata[CallResultJSONKey]
+							}
 							results.Set(resultKey(dp.driverIndex, k), res)
 							return res, nil
 						}, ch)
 						if err != nil {
 							return err
 						}
+						if callResult != nil {
+							if rr.ExporterResponse == nil {
+								rr.ExporterResponse = map[string]string{}
+							}
+							rr.ExporterResponse[CallResultKey] = string(callResult)
+							if callResultJSON != nil {
+								rr.ExporterResponse[CallResultJSONKey] = string(callResultJSON)
+							}
+						}
 						res[i] = rr
 
 						d := drivers[dp.driverIndex].Driver
@@ -1176,7 +1216,7 @@ func LoadInputs(ctx context.Context, d driver.Driver, inp Inputs, pw progress.Wr
 			dockerfileName = filepath.Base(inp.DockerfilePath)
 		}
 
-	case urlutil.IsGitURL(inp.ContextPath), urlutil.IsURL(inp.ContextPath):
+	case isRemoteGitOrURL(inp.ContextPath):
 		if inp.DockerfilePath == "-" {
 			return nil, errors.Errorf("Dockerfile from stdin is not supported with remote contexts")
 		}
@@ -1231,7 +1271,7 @@ func LoadInputs(ctx context.Context, d driver.Driver, inp Inputs, pw progress.Wr
 			continue
 		}
 
-		if urlutil.IsGitURL(v.Path) || urlutil.IsURL(v.Path) || strings.HasPrefix(v.Path, "docker-image://") || strings.HasPrefix(v.Path, "target:") {
+		if isRemoteGitOrURL(v.Path) || strings.HasPrefix(v.Path, "docker-image://") || strings.HasPrefix(v.Path, "target:") {
 			target.FrontendAttrs["context:"+k] = v.Path
 			continue
 		}
@@ -1258,6 +1298,12 @@ func LoadInputs(ctx context.Context, d driver.Driver, inp Inputs, pw progress.Wr
 	return release, nil
 }
 
+// isRemoteGitOrURL reports whether p is a remote context handled by the
+// frontend. ssh:// git URLs are not recognized by urlutil.IsGitURL.
+func isRemoteGitOrURL(p string) bool {
+	return urlutil.IsGitURL(p) || urlutil.IsURL(p) || strings.HasPrefix(p, "ssh://")
+}
+
 func resultKey(index int, name string) string {
 	return fmt.Sprintf("%d-%s", index, name)
 }
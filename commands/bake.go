@@ -5,23 +5,49 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/containerd/containerd/platforms"
 	"github.com/docker/buildx/bake"
 	"github.com/docker/buildx/build"
+	"github.com/docker/buildx/driver"
 	"github.com/docker/buildx/util/confutil"
+	"github.com/docker/buildx/util/imagetools"
+	"github.com/docker/buildx/util/platformutil"
 	"github.com/docker/buildx/util/progress"
 	"github.com/docker/buildx/util/tracing"
 	"github.com/docker/cli/cli/command"
+	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/util/appcontext"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 )
 
 type bakeOptions struct {
-	files     []string
-	overrides []string
-	printOnly bool
+	files              []string
+	overrides          []string
+	values             []string
+	platforms          []string
+	profiles           []string
+	printOnly          bool
+	maskArgs           string
+	contextRoot        string
+	warnDirty          bool
+	cacheOnly          bool
+	listTargets        bool
+	lock               bool
+	noEmulationWarning bool
+	noSSHAgentWarning  bool
+	allow              []string
+	overrideOutput     string
+	preserveOutputs    bool
+	strictTags         bool
 	commonOptions
 }
 
@@ -57,13 +83,16 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 	}
 
 	overrides := in.overrides
+	if in.cacheOnly && (in.exportPush || in.exportLoad) {
+		return errors.Errorf("cache-only may not be set together with push or load")
+	}
 	if in.exportPush {
 		if in.exportLoad {
 			return errors.Errorf("push and load may not be set together at the moment")
 		}
 		overrides = append(overrides, "*.push=true")
 	} else if in.exportLoad {
-		overrides = append(overrides, "*.output=type=docker")
+		overrides = append(overrides, "*.output=type=docker", "*.load=true")
 	}
 	if in.noCache != nil {
 		overrides = append(overrides, fmt.Sprintf("*.no-cache=%t", *in.noCache))
@@ -90,6 +119,32 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 	if err != nil {
 		return err
 	}
+	builderDis := map[string][]build.DriverInfo{"": dis}
+	builderInstance := func(name string) ([]build.DriverInfo, error) {
+		if _, ok := builderDis[name]; !ok {
+			d, err := getInstanceOrDefault(ctx, dockerCli, name, contextPathHash)
+			if err != nil {
+				return nil, err
+			}
+			builderDis[name] = d
+		}
+		return builderDis[name], nil
+	}
+	workerPlatformsByBuilder := map[string][]specs.Platform{}
+	builderWorkerPlatforms := func(name string) ([]specs.Platform, error) {
+		if _, ok := workerPlatformsByBuilder[name]; !ok {
+			d, err := builderInstance(name)
+			if err != nil {
+				return nil, err
+			}
+			p, err := workerPlatforms(ctx, d, printer)
+			if err != nil {
+				return nil, err
+			}
+			workerPlatformsByBuilder[name] = p
+		}
+		return workerPlatformsByBuilder[name], nil
+	}
 
 	var files []bake.File
 	var inp *bake.Input
@@ -103,15 +158,147 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 		return err
 	}
 
-	tgts, grps, err := bake.ReadTargets(ctx, files, targets, overrides, map[string]string{
+	defaults := map[string]string{
 		// Don't forget to update documentation if you add a new
 		// built-in variable: docs/reference/buildx_bake.md#built-in-variables
 		"BAKE_CMD_CONTEXT":    cmdContext,
 		"BAKE_LOCAL_PLATFORM": platforms.DefaultString(),
+	}
+
+	values, err := bake.ReadValuesFiles(in.values)
+	if err != nil {
+		return err
+	}
+
+	// like compose, profiles are read from COMPOSE_PROFILES if not set
+	profiles := splitProfiles(in.profiles)
+	if len(in.profiles) == 0 {
+		profiles = splitProfiles([]string{os.Getenv("COMPOSE_PROFILES")})
+	}
+
+	if in.preserveOutputs && in.overrideOutput == "" {
+		return errors.Errorf("preserve-outputs requires override-output")
+	}
+
+	opt := bake.ParseOpt{
+		Defaults: defaults,
+		Values:   values,
+		Profiles: profiles,
+	}
+
+	if in.listTargets {
+		cfg, err := bake.ParseFilesWithOpt(files, opt)
+		if err != nil {
+			return err
+		}
+		dt, err := json.MarshalIndent(bake.ListTargets(cfg), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(dockerCli.Out(), string(dt))
+		return nil
+	}
+
+	tgts, grps, warnings, err := bake.ReadTargetsWithOpt(ctx, files, targets, overrides, bake.ReadOpt{
+		ParseOpt:        opt,
+		Output:          in.overrideOutput,
+		PreserveOutputs: in.preserveOutputs,
 	})
 	if err != nil {
 		return err
 	}
+	for _, w := range warnings {
+		logrus.Warn(w)
+	}
+
+	if err := bake.DefaultPlatforms(tgts, in.platforms); err != nil {
+		return err
+	}
+	if in.cacheOnly {
+		bake.ApplyCacheOnly(tgts)
+	}
+
+	if err := bake.ExpandPlatforms(tgts, builderWorkerPlatforms); err != nil {
+		return err
+	}
+
+	if inp == nil && !in.printOnly {
+		if err := bake.ValidateDockerfiles(tgts); err != nil {
+			return err
+		}
+	}
+	if inp == nil {
+		var l *bake.Lockfile
+		lockfile := bake.LockfilePath(files)
+		if in.lock {
+			l, err = bake.GenerateLockfile(ctx, tgts, imagetools.New(dis[0].ImageOpt))
+			if err != nil {
+				return err
+			}
+			if err := bake.WriteLockfile(lockfile, l); err != nil {
+				return err
+			}
+		} else if l, err = bake.ReadLockfile(lockfile); err != nil {
+			return err
+		} else if l != nil {
+			logrus.Infof("pinning base images from %s", lockfile)
+		}
+		bake.ApplyLockfile(tgts, l)
+	} else if in.lock {
+		return errors.New("lock is not supported with a remote bake definition")
+	}
+	if in.contextRoot != "" && inp == nil {
+		if err := bake.ValidateContextsRoot(tgts, in.contextRoot); err != nil {
+			return err
+		}
+	}
+
+	if in.warnDirty && inp == nil && !in.printOnly {
+		warnings, err := bake.DirtyContextWarnings(tgts, nil)
+		if err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			logrus.Warn(w)
+		}
+	}
+
+	if !in.noEmulationWarning && !in.printOnly {
+		for name, m := range bake.TargetsByBuilder(tgts) {
+			if !hasPlatforms(m) {
+				continue
+			}
+			supported, err := builderWorkerPlatforms(name)
+			if err != nil {
+				return err
+			}
+			for _, w := range bake.PlatformEmulationWarnings(m, supported) {
+				logrus.Warn(w)
+			}
+		}
+	}
+
+	if !in.noSSHAgentWarning && !in.printOnly {
+		for _, w := range bake.SSHAgentWarnings(tgts) {
+			logrus.Warn(w)
+		}
+	}
+
+	if !in.printOnly {
+		warnings, err := bake.TagCollisionWarnings(tgts, in.strictTags)
+		if err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			logrus.Warn(w)
+		}
+	}
+
+	if !in.printOnly {
+		if err := bake.ValidateEntitlements(tgts, in.allow); err != nil {
+			return err
+		}
+	}
 
 	// this function can update target context string from the input so call before printOnly check
 	bo, err := bake.TargetsToBuildOpt(tgts, inp)
@@ -120,10 +307,19 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 	}
 
 	if in.printOnly {
+		maskPattern := bake.SensitiveArgsPattern
+		if in.maskArgs != "" {
+			if maskPattern, err = regexp.Compile(in.maskArgs); err != nil {
+				return errors.Wrap(err, "invalid mask-args pattern")
+			}
+		}
 		var defg map[string]*bake.Group
 		if len(grps) == 1 {
+			// targets of the group are sorted for a reproducible output
+			gt := append([]string{}, grps[0].Targets...)
+			sort.Strings(gt)
 			defg = map[string]*bake.Group{
-				"default": grps[0],
+				"default": {Targets: gt},
 			}
 		}
 		dt, err := json.MarshalIndent(struct {
@@ -131,7 +327,7 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 			Target map[string]*bake.Target `json:"target"`
 		}{
 			defg,
-			tgts,
+			bake.MaskArgs(tgts, maskPattern),
 		}, "", "  ")
 		if err != nil {
 			return err
@@ -145,9 +341,67 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 		return nil
 	}
 
-	resp, err := build.Build(ctx, dis, bo, dockerAPI(dockerCli), confutil.ConfigDir(dockerCli), printer)
+	boByBuilder, err := bake.BuildOptsByBuilder(tgts, bo)
 	if err != nil {
-		return wrapBuildError(err, true)
+		return err
+	}
+	for name := range boByBuilder {
+		if _, err := builderInstance(name); err != nil {
+			return err
+		}
+	}
+
+	resp := map[string]*client.SolveResponse{}
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	for name, opts := range boByBuilder {
+		name, opts := name, opts
+		eg.Go(func() error {
+			r, err := build.Build(egCtx, builderDis[name], opts, dockerAPI(dockerCli), confutil.ConfigDir(dockerCli), printer)
+			if err != nil {
+				return wrapBuildError(err, true)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for k, v := range r {
+				resp[k] = v
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	var called, failed []string
+	for k, r := range resp {
+		if _, ok := r.ExporterResponse[build.CallResultKey]; ok {
+			called = append(called, k)
+		}
+	}
+	if len(called) > 0 {
+		err = printer.Wait()
+		printer = nil
+		if err != nil {
+			return err
+		}
+		sort.Strings(called)
+		for _, k := range called {
+			if len(called) > 1 {
+				fmt.Fprintf(dockerCli.Out(), "# %s\n", k)
+			}
+			fmt.Fprint(dockerCli.Out(), resp[k].ExporterResponse[build.CallResultKey])
+			if bo[k].CallFunc != "lint" {
+				continue
+			}
+			n, err := lintWarnings(resp[k].ExporterResponse[build.CallResultJSONKey])
+			if err != nil {
+				return errors.Wrapf(err, "failed to read check result of target %s", k)
+			}
+			if n > 0 {
+				failed = append(failed, k)
+			}
+		}
 	}
 
 	if len(in.metadataFile) > 0 {
@@ -160,6 +414,10 @@ func runBake(dockerCli command.Cli, targets []string, in bakeOptions) (err error
 		}
 	}
 
+	if len(failed) > 0 {
+		return errors.Errorf("check reported warnings for targets: %s", strings.Join(failed, ", "))
+	}
+
 	return err
 }
 
@@ -185,13 +443,91 @@ func bakeCmd(dockerCli command.Cli, rootOpts *rootOptions) *cobra.Command {
 
 	flags := cmd.Flags()
 
+	flags.StringSliceVar(&options.allow, "allow", []string{}, `Allow extra privileged entitlement requested by the targets (e.g., "network.host", "security.insecure")`)
+	flags.BoolVar(&options.cacheOnly, "cache-only", false, "Build without exporting any result")
+	flags.StringVar(&options.contextRoot, "context-root", "", "Reject local build contexts outside of this directory")
 	flags.StringArrayVarP(&options.files, "file", "f", []string{}, "Build definition file")
+	flags.BoolVar(&options.listTargets, "list-targets", false, "List the available targets and groups")
 	flags.BoolVar(&options.exportLoad, "load", false, `Shorthand for "--set=*.output=type=docker"`)
+	flags.StringVar(&options.maskArgs, "mask-args", "", "Mask the values of the build args matching the regular expression when printing")
+	flags.BoolVar(&options.lock, "lock", false, "Pin base images to their digest and write them to bake.lock")
+	flags.BoolVar(&options.noEmulationWarning, "no-emulation-warning", false, "Do not warn about target platforms requiring emulation on the builder")
+	flags.BoolVar(&options.noSSHAgentWarning, "no-ssh-agent-warning", false, "Do not warn about targets requesting the default SSH agent socket while it is not set")
+	flags.StringVar(&options.overrideOutput, "override-output", "", `Set the output of all the targets (format: "type=local,dest=path")`)
+	flags.StringArrayVar(&options.platforms, "platform", nil, "Set target platforms for targets without platforms")
+	flags.BoolVar(&options.preserveOutputs, "preserve-outputs", false, "Only override the image and registry outputs of the targets")
 	flags.BoolVar(&options.printOnly, "print", false, "Print the options without building")
+	flags.StringArrayVar(&options.profiles, "profile", nil, "Activate the services of a compose profile")
 	flags.BoolVar(&options.exportPush, "push", false, `Shorthand for "--set=*.output=type=registry"`)
 	flags.StringArrayVar(&options.overrides, "set", nil, `Override target value (e.g., "targetpattern.key=value")`)
+	flags.BoolVar(&options.strictTags, "strict-tags", false, "Fail when an image tag is set by multiple targets")
+	flags.StringArrayVar(&options.values, "values", nil, "Read variable values from a JSON or YAML file")
+	flags.BoolVar(&options.warnDirty, "warn-dirty-context", false, "Warn when pushing an image built from a git working tree with uncommitted changes")
 
 	commonBuildFlags(&options.commonOptions, flags)
 
 	return cmd
 }
+
+// workerPlatforms boots the nodes of a builder and returns the platforms
+// supported by their workers, including the emulated ones.
+func workerPlatforms(ctx context.Context, dis []build.DriverInfo, pw progress.Writer) ([]specs.Platform, error) {
+	var res []specs.Platform
+	for _, di := range dis {
+		if di.Err != nil {
+			return nil, di.Err
+		}
+		if di.Driver == nil {
+			continue
+		}
+		c, err := driver.Boot(ctx, ctx, di.Driver, pw)
+		if err != nil {
+			return nil, err
+		}
+		workers, err := c.ListWorkers(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing workers")
+		}
+		for _, w := range workers {
+			res = append(res, w.Platforms...)
+		}
+	}
+	return platformutil.Dedupe(res), nil
+}
+
+// splitProfiles splits the comma separated profiles of v.
+func splitProfiles(v []string) []string {
+	var res []string
+	for _, s := range v {
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				res = append(res, p)
+			}
+		}
+	}
+	return res
+}
+
+// lintWarnings returns the number of warnings in the structured result of the
+// lint method. A frontend not setting it reports no warnings.
+func lintWarnings(dt string) (int, error) {
+	if dt == "" {
+		return 0, nil
+	}
+	var res struct {
+		Warnings []json.RawMessage `json:"warnings"`
+	}
+	if err := json.Unmarshal([]byte(dt), &res); err != nil {
+		return 0, err
+	}
+	return len(res.Warnings), nil
+}
+
+func hasPlatforms(m map[string]*bake.Target) bool {
+	for _, t := range m {
+		if len(t.Platforms) > 0 {
+			return true
+		}
+	}
+	return false
+}
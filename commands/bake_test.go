@@ -0,0 +1,24 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintWarnings(t *testing.T) {
+	n, err := lintWarnings("")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = lintWarnings(`{"warnings":[]}`)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = lintWarnings(`{"warnings":[{"ruleName":"StageNameCasing"},{"ruleName":"FromAsCasing"}],"sources":[]}`)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	_, err = lintWarnings("StageNameCasing: Stage name 'Build' should be lowercase")
+	require.Error(t, err)
+}